@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"slices"
 	"strings"
@@ -10,6 +12,7 @@ import (
 	"github.com/galpt/mk-bkconv/pkg/convert"
 	"github.com/galpt/mk-bkconv/pkg/kotatsu"
 	"github.com/galpt/mk-bkconv/pkg/mihon"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
 )
 
 func main() {
@@ -27,7 +30,7 @@ func main() {
 	var sub string
 	subIndex := -1
 	for i, a := range args {
-		if a == "mihon-to-kotatsu" || a == "kotatsu-to-mihon" {
+		if a == "mihon-to-kotatsu" || a == "kotatsu-to-mihon" || a == "mappings" || a == "sources" || a == "mihon-migrate" || a == "kotatsu-migrate" || a == "merge" {
 			sub = a
 			subIndex = i
 			break
@@ -86,49 +89,141 @@ func main() {
 	switch sub {
 	case "mihon-to-kotatsu":
 		fs := flag.NewFlagSet("mihon-to-kotatsu", flag.ExitOnError)
-		in := fs.String("in", "", "input mihon backup file (.tachibk)")
-		out := fs.String("out", "", "output kotatsu zip file")
+		in := fs.String("in", "", "input mihon backup file (.tachibk), - for stdin")
+		out := fs.String("out", "", "output kotatsu zip file, - for stdout")
+		reportOpts := addReportFlags(fs)
+		dryRun := fs.Bool("dry-run", false, "show what would be converted and dropped without writing -out")
+		unmappedOpts := addUnmappedFlags(fs)
+		mappingPath := addMappingFlag(fs)
+		indexPath := addExtensionIndexFlag(fs)
+		catalogPath := addCatalogFlag(fs)
 		fs.Parse(filteredArgs)
-		if *in == "" || *out == "" {
+		if *in == "" || (*out == "" && !*dryRun) {
 			usage()
 			os.Exit(2)
 		}
-		b, err := mihon.LoadBackup(*in)
+		if err := reportOpts.validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		opts, err := unmappedOpts.convertOptions(allowSourcesFallback)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error reading mihon backup: %v\n", err)
-			os.Exit(3)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
-		kb := convert.MihonToKotatsu(b)
-		if err := kotatsu.WriteKotatsuZip(*out, kb); err != nil {
-			fmt.Fprintf(os.Stderr, "error writing kotatsu zip: %v\n", err)
+		opts.DryRun = *dryRun
+		if !*dryRun {
+			if err := unmappedOpts.validateQuarantine(*out); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+		mustLoadMappingFile(*mappingPath)
+		mustLoadExtensionIndex(*indexPath)
+		mustLoadCatalog(*catalogPath)
+		var report *convert.Report
+		if *in != stdioPath && !*dryRun {
+			// a backup file can be read twice, so it is converted without loading it whole
+			report, err = streamMihonToKotatsu(*in, *out, opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error converting mihon backup: %v\n", err)
+				os.Exit(5)
+			}
+		} else {
+			b, err := loadMihon(*in)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error reading mihon backup: %v\n", err)
+				os.Exit(3)
+			}
+			var kb *kotatsu.KotatsuBackup
+			kb, report = convert.MihonToKotatsu(b, opts)
+			if *dryRun {
+				finishDryRun(reportOpts, report)
+				return
+			}
+			if err := writeKotatsu(*out, kb); err != nil {
+				fmt.Fprintf(os.Stderr, "error writing kotatsu zip: %v\n", err)
+				os.Exit(4)
+			}
+		}
+		if err := unmappedOpts.writeQuarantine(report, *out); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing quarantine file: %v\n", err)
 			os.Exit(4)
 		}
-		fmt.Println("Conversion complete.")
+		finish(reportOpts, report, *out)
 
 	case "kotatsu-to-mihon":
 		fs := flag.NewFlagSet("kotatsu-to-mihon", flag.ExitOnError)
-		in := fs.String("in", "", "input kotatsu zip file")
-		out := fs.String("out", "", "output mihon backup file (.tachibk)")
+		in := fs.String("in", "", "input kotatsu zip file, - for stdin")
+		out := fs.String("out", "", "output mihon backup file (.tachibk), - for stdout")
+		reportOpts := addReportFlags(fs)
+		dryRun := fs.Bool("dry-run", false, "show what would be converted and dropped without writing -out")
+		unmappedOpts := addUnmappedFlags(fs)
+		mappingPath := addMappingFlag(fs)
+		indexPath := addExtensionIndexFlag(fs)
+		catalogPath := addCatalogFlag(fs)
 		fs.Parse(filteredArgs)
-		if *in == "" || *out == "" {
+		if *in == "" || (*out == "" && !*dryRun) {
 			usage()
 			os.Exit(2)
 		}
-		kb, err := kotatsu.LoadKotatsuZip(*in)
+		if err := reportOpts.validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		opts, err := unmappedOpts.convertOptions(allowSourcesFallback)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		opts.DryRun = *dryRun
+		if !*dryRun {
+			if err := unmappedOpts.validateQuarantine(*out); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+		mustLoadMappingFile(*mappingPath)
+		mustLoadExtensionIndex(*indexPath)
+		mustLoadCatalog(*catalogPath)
+		kb, err := loadKotatsu(*in)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error reading kotatsu zip: %v\n", err)
 			os.Exit(3)
 		}
-		b, err := convert.KotatsuToMihon(kb, allowSourcesFallback)
+		b, report, err := convert.KotatsuToMihon(kb, opts)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error converting kotatsu to mihon: %v\n", err)
 			os.Exit(5)
 		}
-		if err := mihon.WriteBackup(*out, b); err != nil {
+		if *dryRun {
+			finishDryRun(reportOpts, report)
+			return
+		}
+		if err := writeMihon(*out, b); err != nil {
 			fmt.Fprintf(os.Stderr, "error writing mihon backup: %v\n", err)
 			os.Exit(4)
 		}
-		fmt.Println("Conversion complete.")
+		if err := unmappedOpts.writeQuarantine(report, *out); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing quarantine file: %v\n", err)
+			os.Exit(4)
+		}
+		finish(reportOpts, report, *out)
+
+	case "mappings":
+		runMappings(filteredArgs)
+
+	case "sources":
+		runSources(filteredArgs)
+
+	case "mihon-migrate":
+		runMihonMigrate(filteredArgs)
+
+	case "kotatsu-migrate":
+		runKotatsuMigrate(filteredArgs)
+
+	case "merge":
+		runMerge(filteredArgs, allowSourcesFallback)
 
 	default:
 		usage()
@@ -136,10 +231,119 @@ func main() {
 	}
 }
 
+// stdioPath is the -in / -out value that selects stdin / stdout
+const stdioPath = "-"
+
+// statusOutput returns where progress messages go: stderr when the backup itself is written to stdout
+func statusOutput(out string) io.Writer {
+	if out == stdioPath {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// finish shows the conversion report and the completion message
+func finish(o *reportOptions, report *convert.Report, out string) {
+	console := statusOutput(out)
+	if err := o.emit(report, console); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing report: %v\n", err)
+		os.Exit(6)
+	}
+	if !o.quiet {
+		fmt.Fprintln(console, "Conversion complete.")
+	}
+}
+
+// finishDryRun shows the report of a conversion whose output was not written
+func finishDryRun(o *reportOptions, report *convert.Report) {
+	if err := o.emit(report, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing report: %v\n", err)
+		os.Exit(6)
+	}
+	if !o.quiet {
+		fmt.Println("Dry run: no output written.")
+	}
+}
+
+func loadMihon(in string) (*pb.Backup, error) {
+	if in == stdioPath {
+		return mihon.ReadBackup(os.Stdin)
+	}
+	return mihon.LoadBackup(in)
+}
+
+func writeMihon(out string, b *pb.Backup) error {
+	if out == stdioPath {
+		return mihon.WriteBackupTo(os.Stdout, b)
+	}
+	return mihon.WriteBackup(out, b)
+}
+
+// loadKotatsu reads a Kotatsu zip; zips need random access so stdin is buffered in memory
+func loadKotatsu(in string) (*kotatsu.KotatsuBackup, error) {
+	if in != stdioPath {
+		return kotatsu.LoadKotatsuZip(in)
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return kotatsu.ReadKotatsuZip(bytes.NewReader(data), int64(len(data)))
+}
+
+// streamMihonToKotatsu converts the Mihon backup file in with convert.MihonToKotatsuStream
+func streamMihonToKotatsu(in, out string, opts convert.Options) (*convert.Report, error) {
+	var w *kotatsu.ZipStreamWriter
+	if out == stdioPath {
+		w = kotatsu.NewZipStreamWriter(os.Stdout)
+	} else {
+		var err error
+		if w, err = kotatsu.CreateKotatsuZip(out); err != nil {
+			return nil, err
+		}
+	}
+	report, err := convert.MihonToKotatsuStream(func() (io.ReadCloser, error) { return os.Open(in) }, w, opts)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && out != stdioPath {
+		// do not leave a half written backup behind
+		os.Remove(out)
+	}
+	return report, err
+}
+
+func writeKotatsu(out string, kb *kotatsu.KotatsuBackup) error {
+	if out == stdioPath {
+		return kotatsu.WriteKotatsuZipTo(os.Stdout, kb)
+	}
+	return kotatsu.WriteKotatsuZip(out, kb)
+}
+
 func usage() {
 	fmt.Println("mk-bkconv: convert between Mihon and Kotatsu backups")
 	fmt.Println("USAGE:")
 	fmt.Println("  mk-bkconv <mihon-to-kotatsu|kotatsu-to-mihon> -in <input> -out <output> --allow-fallback")
+	fmt.Println("  mk-bkconv mappings list [--mapping <file>] [--format text|json]")
+	fmt.Println("  mk-bkconv sources scan [dir] [-out <catalog>]   scan kotatsu-parsers / extensions-source checkouts (default $REFERENCES_ROOT) into a source catalog")
+	fmt.Println("  mk-bkconv mihon-migrate -in <input> -out <output> -from <sourceId|name> -to <name/lang/version> [-url-from <regexp> -url-to <replacement>]")
+	fmt.Println("  mk-bkconv kotatsu-migrate -in <input> -out <output> -from <parser> -to <parser>")
+	fmt.Println("  mk-bkconv merge -out <output> [-format mihon|kotatsu] <backup> <backup>...   merge .tachibk and kotatsu .zip backups into one library")
+	fmt.Println("  mihon-to-kotatsu reads a backup file three times, keeping the source, URL, title and categories of each manga")
+	fmt.Println("  (about 100 bytes plus those strings) and its history, bookmarks and tracking in memory;")
+	fmt.Println("  stdin, --dry-run and the other commands load the whole backup")
 	fmt.Println("    --allow-fallback   this flag allows you to fallback to hashing when there was no mapping for a source found")
-
+	fmt.Println("    -in - / -out -     read the backup from stdin / write it to stdout (requires an explicit subcommand)")
+	fmt.Println("    --report-format    conversion report format: text (default) or json")
+	fmt.Println("    --report <file>    write the conversion report to a file")
+	fmt.Println("    --quiet            do not print the conversion report or progress messages")
+	fmt.Println("    --unmapped <p>     drop (default), keep, category or quarantine manga whose source cannot be mapped")
+	fmt.Println("    --quarantine <f>   side-car .json/.csv file for --unmapped quarantine (default <out>.quarantine.json)")
+	fmt.Println("    --dry-run          list what would be converted and dropped (and the mapping each dropped manga needs) without writing -out")
+	fmt.Println("    --domain-confidence <c>  minimum confidence (default 1) for applying sources matched by website domain; 0.8 accepts an unconfirmed language, 0.5 mirror domains")
+	fmt.Println("    --mapping <file>   JSON source mapping file merged over the built-in table")
+	fmt.Println("                       (default $" + convert.MappingFileEnv + ", then <config dir>/mk-bkconv/mappings.json if present)")
+	fmt.Println("    --extension-index <file>  locally saved Keiyoushi index.min.json (default <cache dir>/mk-bkconv/index.min.json if present)")
+	fmt.Println("                       required for index-based source IDs: none is built in, without it IDs are computed")
+	fmt.Println("    --catalog <file>   source catalog from \"sources scan\" (default <cache dir>/mk-bkconv/sources.json if present)")
 }
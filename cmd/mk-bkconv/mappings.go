@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"text/tabwriter"
+
+	"github.com/galpt/mk-bkconv/pkg/convert"
+)
+
+// mappingFile is a source mapping file merged over the built-in KnownSourceMapping
+type mappingFile struct {
+	path     string
+	entries  map[string]convert.SourceMapping
+	builtins map[string]struct{}
+}
+
+func addMappingFlag(fs *flag.FlagSet) *string {
+	return fs.String("mapping", "", "JSON source mapping file merged over the built-in table (default $"+convert.MappingFileEnv+" or "+convert.DefaultMappingFile()+")")
+}
+
+// resolveMappingPath picks the mapping file: the flag, then the environment, then
+// the default config location when it exists. required reports whether a missing
+// file is an error.
+func resolveMappingPath(flagPath string) (path string, required bool) {
+	if flagPath != "" {
+		return flagPath, true
+	}
+	if env := os.Getenv(convert.MappingFileEnv); env != "" {
+		return env, true
+	}
+	return convert.DefaultMappingFile(), false
+}
+
+// loadMappingFile loads and merges the mapping file, printing every invalid entry.
+// It returns nil when no mapping file is in use.
+func loadMappingFile(flagPath string) (*mappingFile, error) {
+	path, required := resolveMappingPath(flagPath)
+	if path == "" {
+		return nil, nil
+	}
+	entries, entryErrs, err := convert.LoadSourceMappings(path)
+	if err != nil {
+		if !required && errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("load mapping file %s: %w", path, err)
+	}
+	if len(entryErrs) > 0 {
+		for _, e := range entryErrs {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, e)
+		}
+		return nil, fmt.Errorf("mapping file %s has %d invalid entries", path, len(entryErrs))
+	}
+
+	mf := &mappingFile{path: path, entries: entries, builtins: make(map[string]struct{})}
+	for k := range convert.KnownSourceMapping {
+		mf.builtins[k] = struct{}{}
+	}
+	convert.KnownSourceMapping = convert.MergeSourceMappings(convert.KnownSourceMapping, entries)
+	return mf, nil
+}
+
+// mustLoadMappingFile is loadMappingFile for the conversion subcommands
+func mustLoadMappingFile(flagPath string) {
+	if _, err := loadMappingFile(flagPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+// origin describes where the effective entry for key comes from
+func (mf *mappingFile) origin(key string) string {
+	if mf == nil {
+		return "builtin"
+	}
+	if _, ok := mf.entries[key]; !ok {
+		return "builtin"
+	}
+	if _, ok := mf.builtins[key]; ok {
+		return mf.path + " (overrides builtin)"
+	}
+	return mf.path
+}
+
+// runMappings implements "mappings list"
+func runMappings(args []string) {
+	if len(args) == 0 || args[0] != "list" {
+		usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("mappings list", flag.ExitOnError)
+	mappingPath := addMappingFlag(fs)
+	indexPath := addExtensionIndexFlag(fs)
+	format := fs.String("format", "text", "output format: text or json")
+	fs.Parse(args[1:])
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %q (expected text or json)\n", *format)
+		os.Exit(2)
+	}
+
+	mf, err := loadMappingFile(*mappingPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	mustLoadExtensionIndex(*indexPath)
+
+	type listEntry struct {
+		convert.MappingListEntry
+		Origin string `json:"origin"`
+	}
+	var entries []listEntry
+	for _, e := range convert.EffectiveMappings() {
+		entries = append(entries, listEntry{MappingListEntry: e, Origin: mf.origin(e.KotatsuKey)})
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing mappings: %v\n", err)
+			os.Exit(4)
+		}
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KOTATSU\tMIHON NAME\tLANG\tVERSION\tSOURCE ID\tID FROM\tORIGIN")
+	for _, e := range entries {
+		idFrom := "computed"
+		if e.IDFromIndex {
+			idFrom = "index"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", e.KotatsuKey, e.MihonName, e.MihonLang, e.MihonVersionID, e.MihonSourceID, idFrom, e.Origin)
+	}
+	if err := tw.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing mappings: %v\n", err)
+		os.Exit(4)
+	}
+}
+
+func addExtensionIndexFlag(fs *flag.FlagSet) *string {
+	return fs.String("extension-index", "", "locally saved Keiyoushi index.min.json (default "+convert.DefaultExtensionIndexFile()+" if present); required for index-based source IDs, none is built in")
+}
+
+// mustLoadExtensionIndex installs convert.KeiyoushiIndex from the flag or the default
+// index file. Without either, source IDs are computed and no extensions are reported.
+func mustLoadExtensionIndex(path string) {
+	required := path != ""
+	if !required {
+		path = convert.DefaultExtensionIndexFile()
+	}
+	if path == "" {
+		return
+	}
+	idx, err := convert.LoadKeiyoushiIndex(path)
+	if err != nil {
+		if !required && errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "error reading extension index %s: %v\n", path, err)
+		os.Exit(3)
+	}
+	convert.SetKeiyoushiIndex(idx)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/galpt/mk-bkconv/pkg/convert"
+	"github.com/galpt/mk-bkconv/pkg/kotatsu"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+)
+
+// mergeResult is the merge report plus the reports of the conversions it needed
+type mergeResult struct {
+	*convert.MergeReport
+	// Conversions holds, per input not in the output format, the report of converting it
+	Conversions map[string]*convert.Report `json:"conversions,omitempty"`
+}
+
+// backupFormat tells the format of a backup file by its extension
+func backupFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".tachibk":
+		return "mihon", nil
+	case ".zip":
+		return "kotatsu", nil
+	}
+	return "", fmt.Errorf("cannot tell the format of %s (expected .tachibk or .zip)", path)
+}
+
+// runMerge implements "merge": combine Mihon and Kotatsu backups into one library.
+// Inputs are merged in the output format, so only the inputs in the other format
+// are converted.
+func runMerge(args []string, allowFallback bool) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := fs.String("out", "", "output backup file (.tachibk or .zip), - for stdout")
+	format := fs.String("format", "", "output format: mihon or kotatsu (default: from the -out extension)")
+	reportOpts := addReportFlags(fs)
+	unmappedOpts := addUnmappedFlags(fs)
+	// a merge keeps every manga; inputs converted to the output format keep unmapped sources
+	fs.Lookup("unmapped").DefValue = string(convert.UnmappedKeep)
+	fs.Set("unmapped", string(convert.UnmappedKeep))
+	fs.Lookup("unmapped").Usage = "what to do with converted manga whose source cannot be mapped: keep or category"
+	mappingPath := addMappingFlag(fs)
+	indexPath := addExtensionIndexFlag(fs)
+	catalogPath := addCatalogFlag(fs)
+	// allow flags between the input files
+	var inputs []string
+	for fs.Parse(args); fs.NArg() > 0; fs.Parse(args) {
+		inputs = append(inputs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(inputs) < 2 || *out == "" {
+		usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		if *out == stdioPath {
+			fmt.Fprintln(os.Stderr, "-format is required when writing to stdout")
+			os.Exit(2)
+		}
+		f, err := backupFormat(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		*format = f
+	}
+	if *format != "mihon" && *format != "kotatsu" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q (expected mihon or kotatsu)\n", *format)
+		os.Exit(2)
+	}
+	if err := reportOpts.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	opts, err := unmappedOpts.convertOptions(allowFallback)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if opts.Unmapped != convert.UnmappedKeep && opts.Unmapped != convert.UnmappedCategory {
+		fmt.Fprintf(os.Stderr, "merge never removes manga: -unmapped must be keep or category, got %s\n", opts.Unmapped)
+		os.Exit(2)
+	}
+	mustLoadMappingFile(*mappingPath)
+	mustLoadExtensionIndex(*indexPath)
+	mustLoadCatalog(*catalogPath)
+
+	// Inputs in the output format are merged as they are; only the others are converted
+	result := mergeResult{Conversions: make(map[string]*convert.Report)}
+	var mihonBackups []*pb.Backup
+	var kotatsuBackups []*kotatsu.KotatsuBackup
+	for _, in := range inputs {
+		if in == stdioPath {
+			fmt.Fprintln(os.Stderr, "merge inputs cannot be read from stdin")
+			os.Exit(2)
+		}
+		f, err := backupFormat(in)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		var report *convert.Report
+		if f == "mihon" {
+			b, err := loadMihon(in)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error reading mihon backup %s: %v\n", in, err)
+				os.Exit(3)
+			}
+			if *format == "mihon" {
+				mihonBackups = append(mihonBackups, b)
+				continue
+			}
+			var kb *kotatsu.KotatsuBackup
+			kb, report = convert.MihonToKotatsu(b, opts)
+			kotatsuBackups = append(kotatsuBackups, kb)
+		} else {
+			kb, err := loadKotatsu(in)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error reading kotatsu zip %s: %v\n", in, err)
+				os.Exit(3)
+			}
+			if *format == "kotatsu" {
+				kotatsuBackups = append(kotatsuBackups, kb)
+				continue
+			}
+			var b *pb.Backup
+			b, report, err = convert.KotatsuToMihon(kb, opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error converting %s to mihon: %v\n", in, err)
+				os.Exit(5)
+			}
+			mihonBackups = append(mihonBackups, b)
+		}
+		result.Conversions[in] = report
+	}
+
+	if *format == "mihon" {
+		var merged *pb.Backup
+		merged, result.MergeReport = convert.MergeMihonBackups(mihonBackups)
+		err = writeMihon(*out, merged)
+	} else {
+		var merged *kotatsu.KotatsuBackup
+		merged, result.MergeReport, err = convert.MergeKotatsuBackups(kotatsuBackups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error merging kotatsu backups: %v\n", err)
+			os.Exit(5)
+		}
+		err = writeKotatsu(*out, merged)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing %s backup: %v\n", *format, err)
+		os.Exit(4)
+	}
+
+	console := statusOutput(*out)
+	if err := reportOpts.emitWith(result, func(w io.Writer) { writeMergeReport(w, inputs, result) }, console); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing report: %v\n", err)
+		os.Exit(6)
+	}
+	if !reportOpts.quiet {
+		fmt.Fprintln(console, "Merge complete.")
+	}
+}
+
+func writeMergeReport(w io.Writer, inputs []string, r mergeResult) {
+	fmt.Fprintf(w, "\n=== Merge Summary ===\n")
+	fmt.Fprintf(w, "✅ Merged %d backups into %d manga and %d categories\n", r.Inputs, r.Manga, r.Categories)
+	fmt.Fprintf(w, "✅ Combined %d duplicate manga\n\n", r.Duplicates)
+
+	fmt.Fprintf(w, "📋 Inputs:\n")
+	for i, in := range inputs {
+		fmt.Fprintf(w, "   %d. %s\n", i+1, in)
+	}
+	fmt.Fprintln(w)
+
+	if len(r.Conflicts) > 0 {
+		fmt.Fprintf(w, "ℹ️  Manga whose copies differed:\n")
+		for _, c := range r.Conflicts {
+			fmt.Fprintf(w, "   • %s (%s): kept input %d, %s\n", c.Title, c.Url, c.Kept+1, c.Reason)
+		}
+		fmt.Fprintln(w)
+	}
+
+	for _, path := range inputs {
+		c, ok := r.Conversions[path]
+		if !ok || len(c.DroppedManga) == 0 && len(c.KeptUnmapped) == 0 && len(c.Fallbacks) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "⚠️  Converting %s:\n", path)
+		for _, d := range c.DroppedManga {
+			source := d.Source
+			if source == "" {
+				source = fmt.Sprintf("source ID %d", d.SourceID)
+			}
+			fmt.Fprintf(w, "   • dropped %s [%s]: %s\n", d.Title, source, d.Reason)
+		}
+		for _, d := range c.KeptUnmapped {
+			fmt.Fprintf(w, "   • kept %s without a source mapping: %s\n", d.Title, d.Reason)
+		}
+		for _, f := range c.Fallbacks {
+			fmt.Fprintf(w, "   • hashed source ID for %s\n", f)
+		}
+		fmt.Fprintln(w)
+	}
+}
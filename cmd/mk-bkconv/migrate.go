@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/galpt/mk-bkconv/pkg/convert"
+)
+
+// runMihonMigrate implements "mihon-migrate": move the manga of one source to another
+func runMihonMigrate(args []string) {
+	fs := flag.NewFlagSet("mihon-migrate", flag.ExitOnError)
+	in := fs.String("in", "", "input mihon backup file (.tachibk), - for stdin")
+	out := fs.String("out", "", "output mihon backup file (.tachibk), - for stdout")
+	from := fs.String("from", "", "source ID or name (as listed in the backup) to migrate from")
+	to := fs.String("to", "", "target source as name/lang/version, e.g. MangaDex/en/1")
+	urlFrom := fs.String("url-from", "", "regular expression matching the manga and chapter URLs to rewrite")
+	urlTo := fs.String("url-to", "", "replacement for -url-from matches ($1 refers to a capture group)")
+	reportOpts := addReportFlags(fs)
+	indexPath := addExtensionIndexFlag(fs)
+	fs.Parse(args)
+	if *in == "" || *out == "" || *from == "" || *to == "" {
+		usage()
+		os.Exit(2)
+	}
+	// an empty -url-to is allowed but must be given, so a lone -url-from cannot erase URLs
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["url-from"] != set["url-to"] {
+		fmt.Fprintln(os.Stderr, "-url-from and -url-to must be given together")
+		os.Exit(2)
+	}
+	if err := reportOpts.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	target, err := convert.ParseMihonTarget(*to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	mig := convert.MihonMigration{From: *from, To: target}
+	if set["url-from"] {
+		re, err := regexp.Compile(*urlFrom)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -url-from: %v\n", err)
+			os.Exit(2)
+		}
+		mig.URLs = &convert.URLRewrite{Pattern: re, Replacement: *urlTo}
+	}
+	mustLoadExtensionIndex(*indexPath)
+
+	b, err := loadMihon(*in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading mihon backup: %v\n", err)
+		os.Exit(3)
+	}
+	report, err := convert.MigrateMihonSource(b, mig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error migrating source: %v\n", err)
+		os.Exit(5)
+	}
+	if err := writeMihon(*out, b); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing mihon backup: %v\n", err)
+		os.Exit(4)
+	}
+
+	console := statusOutput(*out)
+	if err := reportOpts.emitWith(report, func(w io.Writer) { writeMigrationReport(w, report) }, console); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing report: %v\n", err)
+		os.Exit(6)
+	}
+	if !reportOpts.quiet {
+		fmt.Fprintln(console, "Migration complete.")
+	}
+}
+
+func writeMigrationReport(w io.Writer, r *convert.MigrationReport) {
+	from := r.FromName
+	if from == "" {
+		from = "source"
+	}
+	fmt.Fprintf(w, "\n=== Migration Summary ===\n")
+	fmt.Fprintf(w, "✅ Migrated %d manga from %s (Source ID: %d) to %s (Source ID: %d)\n\n", r.Migrated, from, r.FromID, r.ToName, r.ToID)
+	if len(r.NotMigrated) > 0 {
+		fmt.Fprintf(w, "⚠️  Left %d manga on %s:\n", len(r.NotMigrated), from)
+		for _, d := range r.NotMigrated {
+			fmt.Fprintf(w, "   • %s (%s): %s\n", d.Title, d.Url, d.Reason)
+		}
+		fmt.Fprintln(w)
+	}
+	if r.UnmatchedURLs > 0 {
+		fmt.Fprintf(w, "⚠️  Kept %d chapter / history URLs that did not match -url-from\n\n", r.UnmatchedURLs)
+	}
+}
+
+// runKotatsuMigrate implements "kotatsu-migrate": rename a parser in a Kotatsu backup
+func runKotatsuMigrate(args []string) {
+	fs := flag.NewFlagSet("kotatsu-migrate", flag.ExitOnError)
+	in := fs.String("in", "", "input kotatsu zip file, - for stdin")
+	out := fs.String("out", "", "output kotatsu zip file, - for stdout")
+	from := fs.String("from", "", "Kotatsu parser to migrate from, e.g. NIGHTSCANS")
+	to := fs.String("to", "", "Kotatsu parser to migrate to, e.g. QISCANS")
+	reportOpts := addReportFlags(fs)
+	fs.Parse(args)
+	if *in == "" || *out == "" || *from == "" || *to == "" {
+		usage()
+		os.Exit(2)
+	}
+	if err := reportOpts.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	kb, err := loadKotatsu(*in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading kotatsu zip: %v\n", err)
+		os.Exit(3)
+	}
+	report, err := convert.MigrateKotatsuSource(kb, convert.KotatsuMigration{From: *from, To: *to})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error migrating source: %v\n", err)
+		os.Exit(5)
+	}
+	if err := writeKotatsu(*out, kb); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing kotatsu zip: %v\n", err)
+		os.Exit(4)
+	}
+
+	console := statusOutput(*out)
+	if err := reportOpts.emitWith(report, func(w io.Writer) { writeKotatsuMigrationReport(w, report) }, console); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing report: %v\n", err)
+		os.Exit(6)
+	}
+	if !reportOpts.quiet {
+		fmt.Fprintln(console, "Migration complete.")
+	}
+}
+
+func writeKotatsuMigrationReport(w io.Writer, r *convert.KotatsuMigrationReport) {
+	fmt.Fprintf(w, "\n=== Migration Summary ===\n")
+	fmt.Fprintf(w, "✅ Migrated %d manga from %s to %s\n\n", r.Migrated, r.From, r.To)
+	if len(r.NotMigrated) > 0 {
+		fmt.Fprintf(w, "⚠️  Left %d manga on %s:\n", len(r.NotMigrated), r.From)
+		for _, d := range r.NotMigrated {
+			fmt.Fprintf(w, "   • %s (%s): %s\n", d.Title, d.Url, d.Reason)
+		}
+		fmt.Fprintln(w)
+	}
+	if r.UnknownChapters > 0 {
+		fmt.Fprintf(w, "⚠️  %d history or bookmark chapters are not in the chapter index and keep their old ID:\n", r.UnknownChapters)
+		for _, warning := range r.Warnings {
+			fmt.Fprintf(w, "   • %s\n", warning)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/galpt/mk-bkconv/pkg/convert"
+)
+
+// reportOptions holds the flags controlling how the conversion report is shown
+type reportOptions struct {
+	format string
+	path   string
+	quiet  bool
+}
+
+func addReportFlags(fs *flag.FlagSet) *reportOptions {
+	o := &reportOptions{}
+	fs.StringVar(&o.format, "report-format", "text", "conversion report format: text or json")
+	fs.StringVar(&o.path, "report", "", "write the conversion report to this file instead of the console")
+	fs.BoolVar(&o.quiet, "quiet", false, "do not print the conversion report or progress messages")
+	return o
+}
+
+func (o *reportOptions) validate() error {
+	if o.format != "text" && o.format != "json" {
+		return fmt.Errorf("unknown report format %q (expected text or json)", o.format)
+	}
+	return nil
+}
+
+// emit writes the report to the report file, or to console unless quiet is set.
+// console is stderr when the backup itself goes to stdout.
+func (o *reportOptions) emit(r *convert.Report, console io.Writer) error {
+	return o.emitWith(r, func(w io.Writer) { writeTextReport(w, r) }, console)
+}
+
+// emitWith is emit for any report value; writeText renders the text format
+func (o *reportOptions) emitWith(v any, writeText func(io.Writer), console io.Writer) error {
+	var w io.Writer
+	if o.path != "" {
+		f, err := os.Create(o.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	} else if o.quiet {
+		return nil
+	} else {
+		w = console
+	}
+
+	if o.format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	writeText(w)
+	return nil
+}
+
+func writeTextReport(w io.Writer, r *convert.Report) {
+	fmt.Fprintf(w, "\n=== Conversion Summary ===\n")
+	if r.ExtensionRepoAdded {
+		fmt.Fprintf(w, "✅ Added Keiyoushi extension repository to backup\n")
+	}
+	fmt.Fprintf(w, "✅ Converted %d manga entries\n", r.ConvertedManga)
+	fmt.Fprintf(w, "✅ Found %d unique sources\n\n", len(r.Sources))
+
+	if len(r.Sources) > 0 {
+		fmt.Fprintf(w, "📋 Sources in this backup:\n")
+		for i, src := range r.Sources {
+			name := src.Name
+			if name == "" {
+				name = src.Kotatsu
+			}
+			fmt.Fprintf(w, "   %d. %s (Source ID: %d, %d manga)\n", i+1, name, src.ID, src.MangaCount)
+			if src.Extension != "" {
+				fmt.Fprintf(w, "      extension: %s\n", src.Extension)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.DroppedManga) > 0 {
+		fmt.Fprintf(w, "⚠️  Dropped %d manga:\n", len(r.DroppedManga))
+		for _, d := range r.DroppedManga {
+			source := d.Source
+			if source == "" {
+				source = fmt.Sprintf("source ID %d", d.SourceID)
+			}
+			fmt.Fprintf(w, "   • %s [%s]: %s\n", d.Title, source, d.Reason)
+			if d.Rule != "" {
+				fmt.Fprintf(w, "     needs: %s\n", d.Rule)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.KeptUnmapped) > 0 {
+		fmt.Fprintf(w, "ℹ️  Kept %d manga without a source mapping:\n", len(r.KeptUnmapped))
+		for _, d := range r.KeptUnmapped {
+			source := d.Source
+			if source == "" {
+				source = fmt.Sprintf("source ID %d", d.SourceID)
+			}
+			fmt.Fprintf(w, "   • %s [%s]\n", d.Title, source)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.Fallbacks) > 0 {
+		fmt.Fprintf(w, "⚠️  Sources without a known mapping (hashed IDs, reassign after restoring):\n")
+		for _, f := range r.Fallbacks {
+			fmt.Fprintf(w, "   • %s\n", f)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.DomainMatches) > 0 {
+		fmt.Fprintf(w, "🔗 Sources matched by website domain (verify low-confidence matches after restoring):\n")
+		for _, m := range r.DomainMatches {
+			applied := ""
+			if !m.Applied {
+				applied = " (not applied, below --domain-confidence)"
+			}
+			fmt.Fprintf(w, "   • %s → %s (%s), %.0f%% confidence: %s%s\n", m.Kotatsu, m.MihonName, m.MihonLang, m.Confidence*100, m.Reason, applied)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.SourceIDMismatches) > 0 {
+		fmt.Fprintf(w, "⚠️  Source IDs published in the extension index differ from the computed ones (published IDs used):\n")
+		for _, m := range r.SourceIDMismatches {
+			fmt.Fprintf(w, "   • %s → %s (%s): computed %d, published %d\n", m.Kotatsu, m.MihonName, m.MihonLang, m.ComputedID, m.PublishedID)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.UnmappedFields) > 0 {
+		fmt.Fprintf(w, "ℹ️  Data the target format cannot hold:\n")
+		for _, name := range r.UnmappedFieldNames() {
+			fmt.Fprintf(w, "   • %s: %d\n", name, r.UnmappedFields[name])
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.UntranslatedPreferences) > 0 {
+		fmt.Fprintf(w, "ℹ️  Settings without an equivalent in the target app: %s\n\n", strings.Join(r.UntranslatedPreferences, ", "))
+	}
+
+	if len(r.Warnings) > 0 {
+		fmt.Fprintf(w, "⚠️  Warnings:\n")
+		for _, warning := range r.Warnings {
+			fmt.Fprintf(w, "   • %s\n", warning)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if r.Direction == convert.DirectionKotatsuToMihon && len(r.Sources) > 0 && !r.DryRun {
+		writeMihonRestoreGuide(w)
+	}
+}
+
+func writeMihonRestoreGuide(w io.Writer) {
+	fmt.Fprintln(w, strings.Repeat("=", 60))
+	fmt.Fprintf(w, "📱 HOW TO USE THIS BACKUP IN MIHON:\n")
+	fmt.Fprint(w, strings.Repeat("=", 60)+"\n\n")
+	fmt.Fprintf(w, "STEP 1: Restore the backup\n")
+	fmt.Fprintf(w, "   • Open Mihon → Settings → Backup and restore\n")
+	fmt.Fprintf(w, "   • Select 'Restore backup' and choose the .tachibk file\n")
+	fmt.Fprintf(w, "   • The Keiyoushi extension repo will be automatically added\n\n")
+
+	fmt.Fprintf(w, "STEP 2: Install required extensions\n")
+	fmt.Fprintf(w, "   • Open Mihon → Browse → Extensions tab\n")
+	fmt.Fprintf(w, "   • You'll see the sources list above\n")
+	fmt.Fprintf(w, "   • Search for each source name and install its extension\n")
+	fmt.Fprintf(w, "   • Extensions are automatically trusted from Keiyoushi repo\n\n")
+
+	fmt.Fprintf(w, "STEP 3: Verify your manga\n")
+	fmt.Fprintf(w, "   • Go to Library tab\n")
+	fmt.Fprintf(w, "   • Your manga should now be readable\n")
+	fmt.Fprintf(w, "   • Tap any manga to verify chapters are available\n\n")
+
+	fmt.Fprintf(w, "💡 TIP: Extension names usually match source names\n")
+	fmt.Fprintf(w, "   Example: 'MangaDex' source → install 'MangaDex' extension\n\n")
+	fmt.Fprint(w, strings.Repeat("=", 60)+"\n\n")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/galpt/mk-bkconv/pkg/convert"
+)
+
+func addCatalogFlag(fs *flag.FlagSet) *string {
+	return fs.String("catalog", "", "source catalog written by \"sources scan\" (default "+convert.DefaultCatalogFile()+" if present)")
+}
+
+// mustLoadCatalog sets convert.Catalog from the flag or the default catalog file.
+// Without either the filters only know the built-in mappings. A REFERENCES_ROOT
+// without a catalog is an error: the checkouts are only read by "sources scan".
+func mustLoadCatalog(path string) {
+	required := path != ""
+	if !required {
+		path = convert.DefaultCatalogFile()
+	}
+	c, err := convert.LoadSourceCatalog(path)
+	if err != nil {
+		if !required && errors.Is(err, fs.ErrNotExist) {
+			if root := os.Getenv(convert.ReferencesRootEnv); root != "" {
+				fmt.Fprintf(os.Stderr, "no source catalog at %s; %s is no longer walked during conversions, run: mk-bkconv sources scan %s\n", path, convert.ReferencesRootEnv, root)
+				os.Exit(2)
+			}
+			return
+		}
+		fmt.Fprintf(os.Stderr, "error reading source catalog %s: %v\n", path, err)
+		os.Exit(3)
+	}
+	convert.Catalog = c
+}
+
+// runSources implements "sources scan [dir]"; dir defaults to $REFERENCES_ROOT
+func runSources(args []string) {
+	if len(args) == 0 || args[0] != "scan" {
+		usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("sources scan", flag.ExitOnError)
+	out := fs.String("out", convert.DefaultCatalogFile(), "where to write the source catalog")
+	fs.Parse(args[1:])
+	// allow flags after the directory as well
+	var dir string
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+	}
+	if dir == "" {
+		dir = os.Getenv(convert.ReferencesRootEnv)
+	}
+	if dir == "" || fs.NArg() > 0 || *out == "" {
+		usage()
+		os.Exit(2)
+	}
+
+	c, err := convert.ScanSources(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error scanning %s: %v\n", dir, err)
+		os.Exit(3)
+	}
+	if err := convert.WriteSourceCatalog(*out, c); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing source catalog: %v\n", err)
+		os.Exit(4)
+	}
+	fmt.Printf("Found %d Kotatsu parsers and %d Mihon sources, catalog written to %s\n", len(c.KotatsuParsers), len(c.MihonSources), *out)
+}
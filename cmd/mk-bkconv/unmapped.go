@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/galpt/mk-bkconv/pkg/convert"
+)
+
+// unmappedOptions holds the flags deciding what happens to manga without a source mapping
+type unmappedOptions struct {
+	policy           string
+	quarantine       string
+	domainConfidence float64
+}
+
+func addUnmappedFlags(fs *flag.FlagSet) *unmappedOptions {
+	o := &unmappedOptions{}
+	fs.StringVar(&o.policy, "unmapped", string(convert.UnmappedDrop), "what to do with manga whose source cannot be mapped: drop, keep, category or quarantine")
+	fs.StringVar(&o.quarantine, "quarantine", "", "side-car file for -unmapped quarantine (.json or .csv), defaults to <out>.quarantine.json")
+	fs.Float64Var(&o.domainConfidence, "domain-confidence", convert.ConfidenceExact, "minimum confidence (0-1) for applying a source matched by website domain; weaker matches are only reported")
+	return o
+}
+
+// convertOptions validates the flags and builds the conversion options
+func (o *unmappedOptions) convertOptions(allowFallback bool) (convert.Options, error) {
+	policy, err := convert.ParseUnmappedPolicy(o.policy)
+	if err != nil {
+		return convert.Options{}, err
+	}
+	if o.domainConfidence <= 0 || o.domainConfidence > 1 {
+		return convert.Options{}, fmt.Errorf("-domain-confidence must be in (0, 1], got %g", o.domainConfidence)
+	}
+	return convert.Options{AllowSourceFallback: allowFallback, Unmapped: policy, MinDomainConfidence: o.domainConfidence}, nil
+}
+
+// validateQuarantine checks up front that quarantined manga have somewhere to go
+func (o *unmappedOptions) validateQuarantine(out string) error {
+	if policy, _ := convert.ParseUnmappedPolicy(o.policy); policy != convert.UnmappedQuarantine {
+		return nil
+	}
+	_, err := o.quarantinePath(out)
+	return err
+}
+
+// quarantinePath returns the side-car file to write, if any
+func (o *unmappedOptions) quarantinePath(out string) (string, error) {
+	if o.quarantine != "" {
+		return o.quarantine, nil
+	}
+	if out == "" || out == stdioPath {
+		return "", fmt.Errorf("-quarantine is required when -unmapped quarantine writes to stdout")
+	}
+	return out + ".quarantine.json", nil
+}
+
+// writeQuarantine writes the quarantined manga of a report to the side-car file
+func (o *unmappedOptions) writeQuarantine(report *convert.Report, out string) error {
+	if len(report.Quarantined) == 0 {
+		return nil
+	}
+	path, err := o.quarantinePath(out)
+	if err != nil {
+		return err
+	}
+	format := "json"
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		format = "csv"
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := convert.WriteQuarantine(f, format, report.Quarantined); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,345 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SourceCatalog lists the Kotatsu parsers and Mihon sources found in local
+// checkouts of kotatsu-parsers and the Mihon extensions source. It is written
+// once by ScanSources and loaded by the filters instead of walking the checkouts
+// on every run.
+type SourceCatalog struct {
+	Root           string          `json:"root"`
+	ScannedAt      time.Time       `json:"scanned_at"`
+	KotatsuParsers []CatalogParser `json:"kotatsu_parsers"`
+	MihonSources   []CatalogSource `json:"mihon_sources"`
+}
+
+// CatalogParser is a Kotatsu parser declared with @MangaSourceParser
+type CatalogParser struct {
+	Name   string `json:"name"` // e.g. "MANGAFIRE_EN"
+	Title  string `json:"title"`
+	Lang   string `json:"lang,omitempty"`
+	Domain string `json:"domain,omitempty"`
+	File   string `json:"file"`
+}
+
+// CatalogSource is a source of a Mihon extension
+type CatalogSource struct {
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	VersionID int    `json:"version_id"`
+	// ID is only set when the extension overrides its source ID
+	ID        int64  `json:"id,omitempty"`
+	BaseURL   string `json:"base_url,omitempty"`
+	Extension string `json:"extension,omitempty"` // extension directory, e.g. "mangadex"
+	File      string `json:"file"`
+}
+
+// SourceID returns the overridden ID of the source or the one generated from name, lang and versionId
+func (s CatalogSource) SourceID() int64 {
+	if s.ID != 0 {
+		return s.ID
+	}
+	return GenerateMihonSourceID(s.Name, s.Lang, s.VersionID)
+}
+
+// Catalog is the catalog used by the filters; nil means only KnownSourceMapping is known
+var Catalog *SourceCatalog
+
+// ReferencesRootEnv names the checkouts folder "sources scan" reads when no directory is given.
+// The filters no longer walk it themselves.
+const ReferencesRootEnv = "REFERENCES_ROOT"
+
+// DefaultCatalogFile returns where "sources scan" writes the catalog by default:
+// <user cache dir>/mk-bkconv/sources.json
+func DefaultCatalogFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mk-bkconv", "sources.json")
+}
+
+var (
+	kotatsuParserPattern = regexp.MustCompile(`@MangaSourceParser\(\s*"([A-Za-z0-9_]+)"\s*,\s*"([^"]*)"(?:\s*,\s*"([^"]*)")?`)
+	kotatsuDomainPattern = regexp.MustCompile(`ConfigKey\.Domain\(\s*"([^"]+)"|MangaParserSource\.\w+\s*,\s*"([^"/\s]+\.[^"/\s]+)"`)
+
+	mihonNamePattern      = regexp.MustCompile(`override\s+val\s+name(?:\s*:\s*String)?\s*=\s*"([^"]+)"`)
+	mihonLangPattern      = regexp.MustCompile(`override\s+val\s+lang(?:\s*:\s*String)?\s*=\s*"([^"]+)"`)
+	mihonBaseURLPattern   = regexp.MustCompile(`override\s+val\s+baseUrl(?:\s*:\s*String)?\s*=\s*"([^"]+)"`)
+	mihonVersionIDPattern = regexp.MustCompile(`override\s+val\s+versionId(?:\s*:\s*Int)?\s*=\s*(\d+)`)
+	mihonIDPattern        = regexp.MustCompile(`override\s+val\s+id(?:\s*:\s*Long)?\s*=\s*(\d+)L?`)
+	// multisrc sources are declared as constructor calls: Madara("Name", "https://site", "en")
+	mihonConstructorPattern = regexp.MustCompile(`\b[A-Z]\w*\(\s*"([^"]+)"\s*,\s*"(https?://[^"]+)"\s*,\s*"([a-z]{2,3}(?:-[A-Za-z]{2,4})?|all)"`)
+)
+
+// mihonExtensionPath matches the package directory of an extension source file
+const mihonExtensionPath = "/eu/kanade/tachiyomi/extension/"
+
+// ScanSources walks root once and extracts Kotatsu parsers (Kotlin files with
+// @MangaSourceParser) and Mihon sources (Kotlin files in extension packages)
+func ScanSources(root string) (*SourceCatalog, error) {
+	c := &SourceCatalog{Root: root, ScannedAt: time.Now().UTC()}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name := d.Name(); path != root && (strings.HasPrefix(name, ".") || name == "build") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".kt") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		rel = filepath.ToSlash(rel)
+		src := string(data)
+		c.KotatsuParsers = append(c.KotatsuParsers, scanKotatsuParsers(src, rel)...)
+		if strings.Contains("/"+rel, mihonExtensionPath) {
+			c.MihonSources = append(c.MihonSources, scanMihonSources(src, rel)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.sort()
+	return c, nil
+}
+
+func scanKotatsuParsers(src, file string) []CatalogParser {
+	var parsers []CatalogParser
+	domain := ""
+	if m := kotatsuDomainPattern.FindStringSubmatch(src); m != nil {
+		domain = m[1] + m[2]
+	}
+	for _, m := range kotatsuParserPattern.FindAllStringSubmatch(src, -1) {
+		parsers = append(parsers, CatalogParser{Name: m[1], Title: m[2], Lang: m[3], Domain: domain, File: file})
+	}
+	return parsers
+}
+
+func scanMihonSources(src, file string) []CatalogSource {
+	// path: .../eu/kanade/tachiyomi/extension/<lang>/<extension>/...
+	var dirLang, extension string
+	if _, rest, ok := strings.Cut("/"+file, mihonExtensionPath); ok {
+		segs := strings.Split(rest, "/")
+		if len(segs) > 2 {
+			dirLang, extension = segs[0], segs[1]
+		}
+	}
+
+	// every property belongs to the innermost class or object declaring it, so a
+	// versionId or id only applies to sources declared in the same class
+	decls := kotlinDeclarations(src)
+	inDecl := func(pattern *regexp.Regexp, decl int) []string {
+		for _, loc := range pattern.FindAllStringSubmatchIndex(src, -1) {
+			if innermostDeclaration(decls, loc[0]) == decl {
+				return []string{src[loc[0]:loc[1]], src[loc[2]:loc[3]]}
+			}
+		}
+		return nil
+	}
+	versionIDOf := func(decl int) int {
+		if m := inDecl(mihonVersionIDPattern, decl); m != nil {
+			v, _ := strconv.Atoi(m[1])
+			return v
+		}
+		return 1
+	}
+	idOf := func(decl int) int64 {
+		if m := inDecl(mihonIDPattern, decl); m != nil {
+			id, _ := strconv.ParseInt(m[1], 10, 64)
+			return id
+		}
+		return 0
+	}
+
+	var sources []CatalogSource
+	for _, loc := range mihonNamePattern.FindAllStringSubmatchIndex(src, -1) {
+		decl := innermostDeclaration(decls, loc[0])
+		s := CatalogSource{Name: src[loc[2]:loc[3]], Lang: dirLang, VersionID: versionIDOf(decl), ID: idOf(decl), Extension: extension, File: file}
+		if m := inDecl(mihonLangPattern, decl); m != nil {
+			s.Lang = m[1]
+		}
+		if m := inDecl(mihonBaseURLPattern, decl); m != nil {
+			s.BaseURL = m[1]
+		}
+		sources = append(sources, s)
+	}
+	for _, loc := range mihonConstructorPattern.FindAllStringSubmatchIndex(src, -1) {
+		decl := innermostDeclaration(decls, loc[0])
+		sources = append(sources, CatalogSource{
+			Name:      src[loc[2]:loc[3]],
+			Lang:      src[loc[6]:loc[7]],
+			VersionID: versionIDOf(decl),
+			ID:        idOf(decl),
+			BaseURL:   src[loc[4]:loc[5]],
+			Extension: extension,
+			File:      file,
+		})
+	}
+	return sources
+}
+
+var kotlinDeclarationPattern = regexp.MustCompile(`\b(?:class|object)\b`)
+
+// kotlinDeclaration is the span of a class or object, from its keyword to the end of its body
+type kotlinDeclaration struct {
+	start, end int
+}
+
+// kotlinDeclarations finds the class and object declarations of a Kotlin file.
+// It only tracks brackets and string literals, which is enough to tell which
+// declaration a property belongs to.
+func kotlinDeclarations(src string) []kotlinDeclaration {
+	var decls []kotlinDeclaration
+	for _, loc := range kotlinDeclarationPattern.FindAllStringIndex(src, -1) {
+		if i := strings.LastIndexByte(src[:loc[0]], '\n'); strings.Count(src[i+1:loc[0]], `"`)%2 == 1 {
+			continue // inside a string literal
+		}
+		decls = append(decls, kotlinDeclaration{loc[0], kotlinDeclarationEnd(src, loc[1])})
+	}
+	return decls
+}
+
+// kotlinDeclarationEnd returns the end of the declaration whose header starts at i:
+// the closing brace of its body, or the end of the header when it has none
+func kotlinDeclarationEnd(src string, i int) int {
+	parens, braces := 0, 0
+	for ; i < len(src); i++ {
+		switch c := src[i]; c {
+		case '"':
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+		case '(':
+			parens++
+		case ')':
+			parens--
+		case '{':
+			if parens == 0 {
+				braces++
+			}
+		case '}':
+			if parens == 0 {
+				braces--
+				if braces <= 0 {
+					return i + 1
+				}
+			}
+		case '\n':
+			if parens != 0 || braces != 0 {
+				continue
+			}
+			// a header without a body ends at a line not continuing it
+			rest := strings.TrimLeft(src[i:], " \t\r\n")
+			if rest == "" || !strings.ContainsAny(rest[:1], "{:,(") {
+				return i
+			}
+		}
+	}
+	return len(src)
+}
+
+// innermostDeclaration returns the index of the smallest declaration containing pos, or -1 for top level
+func innermostDeclaration(decls []kotlinDeclaration, pos int) int {
+	best := -1
+	for i, d := range decls {
+		if d.start <= pos && pos < d.end && (best < 0 || d.end-d.start < decls[best].end-decls[best].start) {
+			best = i
+		}
+	}
+	return best
+}
+
+// sort orders the catalog and removes duplicate entries
+func (c *SourceCatalog) sort() {
+	sort.SliceStable(c.KotatsuParsers, func(i, j int) bool { return c.KotatsuParsers[i].Name < c.KotatsuParsers[j].Name })
+	parsers := c.KotatsuParsers[:0]
+	for i, p := range c.KotatsuParsers {
+		if i == 0 || p.Name != c.KotatsuParsers[i-1].Name {
+			parsers = append(parsers, p)
+		}
+	}
+	c.KotatsuParsers = parsers
+
+	sort.SliceStable(c.MihonSources, func(i, j int) bool {
+		a, b := c.MihonSources[i], c.MihonSources[j]
+		if !strings.EqualFold(a.Name, b.Name) {
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+		return a.Lang < b.Lang
+	})
+	sources := c.MihonSources[:0]
+	for i, s := range c.MihonSources {
+		if i == 0 || !strings.EqualFold(s.Name, c.MihonSources[i-1].Name) || s.Lang != c.MihonSources[i-1].Lang {
+			sources = append(sources, s)
+		}
+	}
+	c.MihonSources = sources
+}
+
+// LoadSourceCatalog reads a catalog written by WriteSourceCatalog
+func LoadSourceCatalog(path string) (*SourceCatalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c SourceCatalog
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("decode source catalog: %w", err)
+	}
+	return &c, nil
+}
+
+// WriteSourceCatalog writes the catalog as JSON, creating parent directories
+func WriteSourceCatalog(path string, c *SourceCatalog) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// kotatsuParserNames returns the lowercased Kotatsu parser names of the catalog
+func (c *SourceCatalog) kotatsuParserNames() map[string]struct{} {
+	names := make(map[string]struct{}, len(c.KotatsuParsers))
+	for _, p := range c.KotatsuParsers {
+		names[strings.ToLower(p.Name)] = struct{}{}
+	}
+	return names
+}
+
+// mihonSourceNames returns the lowercased Mihon source and extension names of the catalog
+func (c *SourceCatalog) mihonSourceNames() map[string]struct{} {
+	names := make(map[string]struct{}, len(c.MihonSources))
+	for _, s := range c.MihonSources {
+		names[strings.ToLower(s.Name)] = struct{}{}
+		if s.Extension != "" {
+			names[strings.ToLower(s.Extension)] = struct{}{}
+		}
+	}
+	return names
+}
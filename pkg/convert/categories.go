@@ -0,0 +1,50 @@
+package convert
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/galpt/mk-bkconv/pkg/kotatsu"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+)
+
+// Mihon restores manga into categories by BackupCategory.order: the values in
+// BackupManga.categories are orders, not IDs. Kotatsu favourites reference
+// categories by ID, so both directions translate between the two.
+
+// kotatsuCategoryOrders assigns the categories of a Kotatsu backup small
+// sequential Mihon orders (by sort key, then creation time) and returns
+// category ID -> order
+func kotatsuCategoryOrders(cats []kotatsu.KotatsuCategory) map[int64]int64 {
+	sorted := slices.Clone(cats)
+	slices.SortStableFunc(sorted, func(a, b kotatsu.KotatsuCategory) int {
+		return cmp.Or(cmp.Compare(a.SortKey, b.SortKey), cmp.Compare(a.CreatedAt, b.CreatedAt), cmp.Compare(a.CategoryId, b.CategoryId))
+	})
+	orders := make(map[int64]int64, len(sorted))
+	for _, c := range sorted {
+		if _, ok := orders[c.CategoryId]; !ok {
+			orders[c.CategoryId] = int64(len(orders))
+		}
+	}
+	return orders
+}
+
+// mihonCategoryIDs assigns the categories of a Mihon backup sequential Kotatsu
+// category IDs (starting at 1, by order). It returns the ID of every category
+// (in the backup's order) and order -> category ID for resolving manga.
+func mihonCategoryIDs(cats []*pb.BackupCategory) ([]int64, map[int64]int64) {
+	index := make([]int, len(cats))
+	for i := range index {
+		index[i] = i
+	}
+	slices.SortStableFunc(index, func(a, b int) int { return cmp.Compare(cats[a].GetOrder(), cats[b].GetOrder()) })
+	ids := make([]int64, len(cats))
+	byOrder := make(map[int64]int64, len(cats))
+	for n, i := range index {
+		ids[i] = int64(n + 1)
+		if _, ok := byOrder[cats[i].GetOrder()]; !ok {
+			byOrder[cats[i].GetOrder()] = ids[i]
+		}
+	}
+	return ids, byOrder
+}
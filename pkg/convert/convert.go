@@ -1,10 +1,14 @@
 package convert
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"maps"
+	"slices"
 	"strings"
+	"unicode"
 
 	"github.com/galpt/mk-bkconv/pkg/kotatsu"
 	pb "github.com/galpt/mk-bkconv/proto/mihon"
@@ -48,72 +52,366 @@ func generateSourceID(sourceName string, allowFallback bool) (int64, error) {
 	return int64(h.Sum64()), nil
 }
 
+// placeholderKotatsuSource builds a Kotatsu-style parser name for a Mihon source
+// without a mapping, e.g. "Some Site" becomes "SOME_SITE"
+func placeholderKotatsuSource(sourceName string, sourceID int64) string {
+	if sourceName == "" {
+		return fmt.Sprintf("MIHON_%d", sourceID)
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, sourceName)
+}
+
 // MihonToKotatsu converts from protobuf-based Mihon backup to Kotatsu backup
-func MihonToKotatsu(b *pb.Backup) *kotatsu.KotatsuBackup {
+func MihonToKotatsu(b *pb.Backup, opts Options) (*kotatsu.KotatsuBackup, *Report) {
+	report := newReport(DirectionMihonToKotatsu)
+	report.DryRun = opts.DryRun
+
 	// Ensure the incoming Mihon backup only contains sources that have a corresponding
-	// Kotatsu source implementation (best-effort). This drops entries that would
-	// otherwise point to missing Kotatsu sources.
-	FilterMihonForKotatsu(b)
+	// Kotatsu source implementation (best-effort). Depending on opts.Unmapped the
+	// other entries are dropped, kept or quarantined.
+	report.applyPlan(PlanFilterMihonForKotatsu(b), b, opts.Unmapped)
 
 	kb := &kotatsu.KotatsuBackup{}
-
+	c := newMihonToKotatsu(b, report)
 	for i, m := range b.BackupManga {
-		fav := kotatsu.KotatsuFavouriteEntry{
-			MangaId:    int64(i + 1),
-			CategoryId: 0, // Will be updated if manga has categories
-			SortKey:    i,
-			Pinned:     false,
-			CreatedAt:  m.GetDateAdded(),
-			Manga: kotatsu.KotatsuManga{
-				Id:         int64(i + 1),
-				Title:      m.GetTitle(),
-				Url:        m.GetUrl(),
-				PublicUrl:  m.GetUrl(),
-				CoverUrl:   m.GetThumbnailUrl(),
-				LargeCover: m.GetThumbnailUrl(),
-				Author:     m.GetAuthor(),
-				Source:     "",
-				Tags:       []interface{}{},
-			},
+		source, found := c.lookupSource(m)
+		favourites := c.favourites(i, m, source, found)
+		kb.Favourites = append(kb.Favourites, favourites...)
+
+		idx, hist, bookmarks, scrobbling := c.chapters(m, source, found, favourites[0].Manga)
+		if len(idx.Chapters) > 0 {
+			kb.Index = append(kb.Index, idx)
+		}
+		if hist != nil {
+			kb.History = append(kb.History, *hist)
 		}
+		kb.Bookmarks = append(kb.Bookmarks, bookmarks...)
+		kb.Scrobbling = append(kb.Scrobbling, scrobbling...)
+	}
+	report.ConvertedManga = len(b.BackupManga)
+	c.settings(b, kb)
+	return kb, report
+}
 
-		// Assign first category if exists
-		if len(m.GetCategories()) > 0 {
-			fav.CategoryId = m.GetCategories()[0]
+// mihonToKotatsu holds what converting the manga of one Mihon backup needs, so
+// MihonToKotatsu and MihonToKotatsuStream convert every manga the same way
+type mihonToKotatsu struct {
+	report            *Report
+	reverse           *ReverseSourceIndex
+	sourceNames       map[int64]string
+	categoryIDs       []int64
+	categoryIDByOrder map[int64]int64
+	sourceIndex       map[string]int
+}
+
+// newMihonToKotatsu prepares the conversion of b, whose manga only need their
+// source and categories at this point
+func newMihonToKotatsu(b *pb.Backup, report *Report) *mihonToKotatsu {
+	c := &mihonToKotatsu{
+		report: report,
+		// Resolve Kotatsu parser names from the Mihon source IDs (and names as a fallback)
+		reverse:     NewReverseSourceIndex(),
+		sourceNames: make(map[int64]string, len(b.BackupSources)),
+		sourceIndex: make(map[string]int),
+	}
+	for _, s := range b.BackupSources {
+		c.sourceNames[s.GetSourceId()] = s.GetName()
+	}
+	// Backups do not always list their sources; the extension index knows the real names
+	for _, m := range b.BackupManga {
+		if c.sourceNames[m.GetSource()] != "" {
+			continue
+		}
+		if s, ok := GetIndexedSource(m.GetSource()); ok {
+			c.sourceNames[m.GetSource()] = s.Name
 		}
+	}
+	c.categoryIDs, c.categoryIDByOrder = mihonCategoryIDs(b.BackupCategories)
+	return c
+}
+
+// lookupSource finds the Kotatsu parser of a manga and records it in the report
+func (c *mihonToKotatsu) lookupSource(m *pb.BackupManga) (string, bool) {
+	source, found := c.reverse.Lookup(m.GetSource(), c.sourceNames[m.GetSource()])
+	if !found {
+		source = placeholderKotatsuSource(c.sourceNames[m.GetSource()], m.GetSource())
+		c.report.Warnings = append(c.report.Warnings, fmt.Sprintf("no Kotatsu source found for %q (source ID %d), using placeholder %s", m.GetTitle(), m.GetSource(), source))
+	}
+	if si, exists := c.sourceIndex[source]; exists {
+		c.report.Sources[si].MangaCount++
+		return source, found
+	}
+	if found {
+		c.report.checkSourceID(source)
+	}
+	c.sourceIndex[source] = len(c.report.Sources)
+	pkg, _ := GetExtensionForSource(m.GetSource())
+	c.report.Sources = append(c.report.Sources, ReportSource{
+		Name:       c.sourceNames[m.GetSource()],
+		ID:         m.GetSource(),
+		Kotatsu:    source,
+		MangaCount: 1,
+		Extension:  pkg,
+	})
+	return source, found
+}
 
-		kb.Favourites = append(kb.Favourites, fav)
+// kotatsuURLs rewrites the URLs of m for its Kotatsu parser
+func kotatsuURLs(m *pb.BackupManga, source string, found bool) (*pb.BackupManga, string) {
+	publicURL := m.GetUrl()
+	if t := urlTransformFor(source); t != nil && found {
+		publicURL = t.PublicURL(m.GetUrl())
+		m = t.withKotatsuURLs(m)
 	}
+	return m, publicURL
+}
 
-	// Convert categories
-	for _, c := range b.BackupCategories {
+// kotatsuManga converts the metadata of a manga
+func kotatsuManga(m *pb.BackupManga, source string, found bool) kotatsu.KotatsuManga {
+	m, publicURL := kotatsuURLs(m, source, found)
+	// Use Kotatsu's own ID scheme so repeated conversions produce the same IDs
+	// and entries merge with an existing Kotatsu library
+	mangaID := kotatsu.GenerateUid(source, m.GetUrl())
+	manga := kotatsu.KotatsuManga{
+		Id:         mangaID,
+		Title:      m.GetTitle(),
+		Url:        m.GetUrl(),
+		PublicUrl:  publicURL,
+		CoverUrl:   m.GetThumbnailUrl(),
+		LargeCover: m.GetThumbnailUrl(),
+		Author:     m.GetAuthor(),
+		Source:     source,
+	}
+	applyMihonMetadata(&manga, m)
+	return manga
+}
+
+// favourites converts the library entry of the i-th manga: one favourite row per
+// category, or a single row without a category. It does not need the chapters.
+func (c *mihonToKotatsu) favourites(i int, m *pb.BackupManga, source string, found bool) []kotatsu.KotatsuFavouriteEntry {
+	manga := kotatsuManga(m, source, found)
+	fav := kotatsu.KotatsuFavouriteEntry{
+		MangaId:    manga.Id,
+		CategoryId: 0, // Replaced per category below
+		SortKey:    i,
+		Pinned:     false,
+		CreatedAt:  m.GetDateAdded(),
+		Manga:      manga,
+	}
+
+	// Fields Kotatsu has no place for
+	if m.GetArtist() != "" && m.GetAuthor() != "" && m.GetArtist() != m.GetAuthor() {
+		c.report.unmapped("artist")
+	}
+	if m.GetNotes() != "" {
+		c.report.unmapped("notes")
+	}
+	if len(m.GetExcludedScanlators()) > 0 {
+		c.report.unmapped("excluded_scanlators")
+	}
+	if m.GetViewerFlags() != 0 {
+		c.report.unmapped("viewer_flags")
+	}
+
+	// Kotatsu stores one favourite row per category the manga belongs to;
+	// Mihon lists the categories by order
+	var favCategories []int64
+	for _, order := range m.GetCategories() {
+		if id, ok := c.categoryIDByOrder[order]; ok && !slices.Contains(favCategories, id) {
+			favCategories = append(favCategories, id)
+		}
+	}
+	if len(favCategories) == 0 {
+		return []kotatsu.KotatsuFavouriteEntry{fav}
+	}
+	favourites := make([]kotatsu.KotatsuFavouriteEntry, 0, len(favCategories))
+	for _, categoryID := range favCategories {
+		catFav := fav
+		catFav.CategoryId = categoryID
+		favourites = append(favourites, catFav)
+	}
+	return favourites
+}
+
+// chapters converts the chapters, history, bookmarks and tracking of a manga;
+// manga is its Kotatsu entry as built by favourites
+func (c *mihonToKotatsu) chapters(m *pb.BackupManga, source string, found bool, manga kotatsu.KotatsuManga) (kotatsu.KotatsuIndexEntry, *kotatsu.KotatsuHistory, []kotatsu.KotatsuBookmark, []kotatsu.KotatsuScrobbling) {
+	m, _ = kotatsuURLs(m, source, found)
+	idx, hist, bookmarks := mihonChaptersToKotatsu(source, manga.Id, m)
+	if hist != nil {
+		hist.Manga = &manga
+	}
+	var scrobbling []kotatsu.KotatsuScrobbling
+	for _, t := range m.GetTracking() {
+		if s, ok := mihonTrackingToKotatsu(t, manga.Id); ok {
+			scrobbling = append(scrobbling, s)
+		} else {
+			c.report.unmapped("tracking")
+		}
+	}
+	return idx, hist, bookmarks, scrobbling
+}
+
+// settings converts the categories and app preferences of b into kb
+func (c *mihonToKotatsu) settings(b *pb.Backup, kb *kotatsu.KotatsuBackup) {
+	if len(b.BackupPreferences) > 0 {
+		var untranslated []string
+		kb.RawSettings, untranslated = mihonPreferencesToKotatsu(b.BackupPreferences)
+		c.report.UntranslatedPreferences = append(c.report.UntranslatedPreferences, untranslated...)
+		if len(untranslated) > 0 {
+			c.report.UnmappedFields["preferences"] += len(untranslated)
+		}
+	}
+	if len(b.BackupSourcePreferences) > 0 {
+		c.report.UnmappedFields["source_preferences"] += len(b.BackupSourcePreferences)
+	}
+
+	for i, cat := range b.BackupCategories {
+		id := c.categoryIDs[i]
 		kb.Categories = append(kb.Categories, kotatsu.KotatsuCategory{
-			CategoryId: c.GetId(),
-			CreatedAt:  c.GetOrder(),
-			SortKey:    0,
-			Title:      c.GetName(),
+			CategoryId: id,
+			SortKey:    int(id - 1),
+			Title:      cat.GetName(),
 		})
 	}
+}
+
+// mihonChaptersToKotatsu builds the Kotatsu chapter list for a manga together with
+// the history row describing where the user left off and a bookmark for every
+// bookmarked chapter. Kotatsu lists chapters oldest first while Mihon's
+// sourceOrder counts from the newest chapter, so chapters are reordered.
+func mihonChaptersToKotatsu(source string, mangaID int64, m *pb.BackupManga) (kotatsu.KotatsuIndexEntry, *kotatsu.KotatsuHistory, []kotatsu.KotatsuBookmark) {
+	idx := kotatsu.KotatsuIndexEntry{MangaId: mangaID}
+
+	chapters := slices.Clone(m.GetChapters())
+	slices.SortStableFunc(chapters, func(a, b *pb.BackupChapter) int {
+		return cmp.Compare(b.GetSourceOrder(), a.GetSourceOrder())
+	})
+
+	lastReadByURL := make(map[string]int64)
+	for _, h := range m.GetHistory() {
+		lastReadByURL[h.GetUrl()] = max(lastReadByURL[h.GetUrl()], h.GetLastRead())
+	}
 
-	return kb
+	var bookmarks []kotatsu.KotatsuBookmark
+	// current is the chapter the user was last reading: the one with the newest
+	// history timestamp, otherwise the furthest chapter with any progress
+	current := -1
+	var currentLastRead int64
+	for i, c := range chapters {
+		kc := kotatsu.KotatsuChapter{
+			Id:         kotatsu.GenerateUid(source, c.GetUrl()),
+			Name:       c.GetName(),
+			Number:     c.GetChapterNumber(),
+			Url:        c.GetUrl(),
+			Scanlator:  c.GetScanlator(),
+			UploadDate: c.GetDateUpload(),
+		}
+		idx.Chapters = append(idx.Chapters, kc)
+
+		if lastRead, ok := lastReadByURL[c.GetUrl()]; ok {
+			if current < 0 || currentLastRead == 0 || lastRead > currentLastRead {
+				current = i
+				currentLastRead = lastRead
+			}
+		} else if currentLastRead == 0 && (c.GetRead() || c.GetLastPageRead() > 0) {
+			current = i
+		}
+
+		if c.GetBookmark() {
+			// Kotatsu keys bookmarks by (manga_id, page_id), so every bookmark needs its own page ID
+			page := int(c.GetLastPageRead())
+			bookmarks = append(bookmarks, kotatsu.KotatsuBookmark{
+				MangaId:   mangaID,
+				PageId:    kotatsu.GenerateUid(source, fmt.Sprintf("%s#%d", c.GetUrl(), page)),
+				ChapterId: kc.Id,
+				Page:      page,
+				CreatedAt: c.GetLastModifiedAt(),
+			})
+		}
+	}
+
+	if current < 0 {
+		return idx, nil, bookmarks
+	}
+
+	c := chapters[current]
+	updatedAt := currentLastRead
+	if updatedAt == 0 {
+		updatedAt = max(c.GetLastModifiedAt(), m.GetLastModifiedAt())
+	}
+	done := current
+	if c.GetRead() {
+		done++
+	}
+	hist := &kotatsu.KotatsuHistory{
+		MangaId:   mangaID,
+		CreatedAt: m.GetDateAdded(),
+		UpdatedAt: updatedAt,
+		ChapterId: idx.Chapters[current].Id,
+		Page:      int(c.GetLastPageRead()),
+		Percent:   float32(done) / float32(len(chapters)),
+	}
+	return idx, hist, bookmarks
 }
 
 // KotatsuToMihon converts from Kotatsu backup to protobuf-based Mihon backup
-func KotatsuToMihon(kb *kotatsu.KotatsuBackup, allowSourceFallback bool) (*pb.Backup, error) {
+func KotatsuToMihon(kb *kotatsu.KotatsuBackup, opts Options) (*pb.Backup, *Report, error) {
 	b := &pb.Backup{}
+	report := newReport(DirectionKotatsuToMihon)
+	report.DryRun = opts.DryRun
 
-	// Build a map of manga ID -> chapters from the index
+	// Keep the most recent history entry per manga; Kotatsu stores one row per manga
+	// but be defensive in case a backup contains duplicates
+	historyByManga := make(map[int64]kotatsu.KotatsuHistory)
+	for _, h := range kb.History {
+		if prev, exists := historyByManga[h.MangaId]; exists && prev.UpdatedAt >= h.UpdatedAt {
+			continue
+		}
+		historyByManga[h.MangaId] = h
+	}
+
+	// Build a map of manga ID -> chapters (and history) from the index
 	chaptersByManga := make(map[int64][]*pb.BackupChapter)
+	mihonHistoryByManga := make(map[int64][]*pb.BackupHistory)
 	for _, idx := range kb.Index {
+		// Locate the chapter the user was last reading; everything before it in the
+		// index is considered read
+		h, hasHistory := historyByManga[idx.MangaId]
+		currentIdx := -1
+		if hasHistory {
+			for i, kc := range idx.Chapters {
+				if kc.Id == h.ChapterId {
+					currentIdx = i
+					break
+				}
+			}
+			if currentIdx < 0 {
+				report.unmapped("history")
+			}
+		}
+
 		var chapters []*pb.BackupChapter
-		for _, kc := range idx.Chapters {
+		for i, kc := range idx.Chapters {
+			read := currentIdx >= 0 && i < currentIdx
+			lastPageRead := int64(0)
+			if i == currentIdx {
+				lastPageRead = int64(h.Page)
+				// percent is the overall manga progress: finishing chapter i gives (i+1)/n
+				read = h.Percent >= float32(i+1)/float32(len(idx.Chapters))
+			}
 			chapters = append(chapters, &pb.BackupChapter{
 				Url:            stringPtr(kc.Url),
 				Name:           stringPtr(kc.Name),
 				Scanlator:      stringPtr(kc.Scanlator),
-				Read:           boolPtr(false),
+				Read:           boolPtr(read),
 				Bookmark:       boolPtr(false),
-				LastPageRead:   int64Ptr(0),
+				LastPageRead:   int64Ptr(lastPageRead),
 				ChapterNumber:  float32Ptr(kc.Number),
 				DateFetch:      int64Ptr(0),
 				DateUpload:     int64Ptr(kc.UploadDate),
@@ -123,20 +421,62 @@ func KotatsuToMihon(kb *kotatsu.KotatsuBackup, allowSourceFallback bool) (*pb.Ba
 			})
 		}
 		chaptersByManga[idx.MangaId] = chapters
+
+		if currentIdx >= 0 && idx.Chapters[currentIdx].Url != "" {
+			mihonHistoryByManga[idx.MangaId] = []*pb.BackupHistory{{
+				Url:          stringPtr(idx.Chapters[currentIdx].Url),
+				LastRead:     int64Ptr(h.UpdatedAt),
+				ReadDuration: int64Ptr(0),
+			}}
+		}
+	}
+
+	// Group tracker links by manga
+	scrobblingByManga := make(map[int64][]kotatsu.KotatsuScrobbling)
+	for _, sc := range kb.Scrobbling {
+		scrobblingByManga[sc.MangaId] = append(scrobblingByManga[sc.MangaId], sc)
+	}
+
+	// Sources without an explicit mapping may still be recognised by their website
+	// matches below the confidence threshold are only reported
+	domainMatches := matchSourcesByDomain(kb.Favourites)
+	for _, key := range slices.Sorted(maps.Keys(domainMatches)) {
+		if match := domainMatches[key]; match.Confidence < opts.minDomainConfidence() {
+			report.DomainMatches = append(report.DomainMatches, match)
+			delete(domainMatches, key)
+		}
 	}
 
 	// Track unique sources and build source mapping
 	sourceMap := make(map[string]int64)
 	var backupSources []*pb.BackupSource
 
-	// Convert favourites to mangas with their chapters
+	// Convert favourites to mangas with their chapters. Kotatsu has one favourite row
+	// per category, so rows for the same manga are folded into a single BackupManga.
+	mangaByID := make(map[int64]*pb.BackupManga)
+	categoryOrders := kotatsuCategoryOrders(kb.Categories)
 	for _, fav := range kb.Favourites {
 		km := fav.Manga
 
+		if m, exists := mangaByID[km.Id]; exists {
+			if order, ok := categoryOrders[fav.CategoryId]; ok && !slices.Contains(m.Categories, order) {
+				m.Categories = append(m.Categories, order)
+			}
+			if fav.CreatedAt < m.GetDateAdded() {
+				m.DateAdded = int64Ptr(fav.CreatedAt)
+			}
+			continue
+		}
+
 		// Generate or retrieve source ID
-		sourceID, err := generateSourceID(km.Source, allowSourceFallback)
-		if err != nil {
-			return nil, err
+		match, domainMatched := domainMatches[km.Source]
+		sourceID := match.SourceID
+		if !domainMatched {
+			var err error
+			sourceID, err = generateSourceID(km.Source, opts.allowFallback())
+			if err != nil {
+				return nil, nil, err
+			}
 		}
 		if _, exists := sourceMap[km.Source]; !exists {
 			sourceMap[km.Source] = sourceID
@@ -145,6 +485,15 @@ func KotatsuToMihon(kb *kotatsu.KotatsuBackup, allowSourceFallback bool) (*pb.Ba
 			if id, name, found := LookupKnownSource(km.Source); found {
 				sourceName = name
 				sourceID = id
+				report.checkSourceID(km.Source)
+			} else if domainMatched {
+				sourceName = match.MihonName
+				match.Applied = true
+				report.DomainMatches = append(report.DomainMatches, match)
+			} else if km.Source == "" {
+				report.Warnings = append(report.Warnings, "manga without a source were assigned to MangaDex")
+			} else {
+				report.Fallbacks = append(report.Fallbacks, km.Source)
 			}
 			backupSources = append(backupSources, &pb.BackupSource{
 				Name:     stringPtr(sourceName),
@@ -158,22 +507,37 @@ func KotatsuToMihon(kb *kotatsu.KotatsuBackup, allowSourceFallback bool) (*pb.Ba
 			Title:          stringPtr(km.Title),
 			Author:         stringPtr(km.Author),
 			Artist:         stringPtr(""),
-			Description:    stringPtr(""),
-			Genre:          []string{},
-			Status:         int32Ptr(0),
 			ThumbnailUrl:   stringPtr(km.CoverUrl),
 			DateAdded:      int64Ptr(fav.CreatedAt),
 			Viewer:         int32Ptr(0),
 			Chapters:       chaptersByManga[km.Id],
-			Categories:     []int64{fav.CategoryId},
 			Favorite:       boolPtr(true),
 			ChapterFlags:   int32Ptr(0),
 			ViewerFlags:    nil,
+			History:        mihonHistoryByManga[km.Id],
 			UpdateStrategy: updateStrategyPtr(pb.UpdateStrategy_ALWAYS_UPDATE),
 			LastModifiedAt: int64Ptr(fav.CreatedAt),
 			Version:        int64Ptr(1),
 			Initialized:    boolPtr(true), // Mark as initialized
 		}
+		if order, ok := categoryOrders[fav.CategoryId]; ok {
+			m.Categories = []int64{order}
+		}
+		applyKotatsuMetadata(m, km)
+		if t := urlTransformFor(km.Source); t != nil {
+			t.rewriteURLsToMihon(m)
+		}
+		for _, sc := range scrobblingByManga[km.Id] {
+			if t, ok := kotatsuScrobblingToMihon(sc, km.Title); ok {
+				m.Tracking = append(m.Tracking, t)
+			} else {
+				report.unmapped("scrobbling")
+			}
+		}
+		if km.Rating > 0 {
+			report.unmapped("rating")
+		}
+		mangaByID[km.Id] = m
 		b.BackupManga = append(b.BackupManga, m)
 	}
 
@@ -181,7 +545,7 @@ func KotatsuToMihon(kb *kotatsu.KotatsuBackup, allowSourceFallback bool) (*pb.Ba
 	for _, c := range kb.Categories {
 		b.BackupCategories = append(b.BackupCategories, &pb.BackupCategory{
 			Name:  stringPtr(c.Title),
-			Order: int64Ptr(c.CreatedAt),
+			Order: int64Ptr(categoryOrders[c.CategoryId]),
 			Id:    int64Ptr(c.CategoryId),
 			Flags: int64Ptr(0),
 		})
@@ -202,41 +566,61 @@ func KotatsuToMihon(kb *kotatsu.KotatsuBackup, allowSourceFallback bool) (*pb.Ba
 		}
 		b.BackupExtensionRepo = []*pb.BackupExtensionRepos{keiyoushiRepo}
 
-		fmt.Printf("\n=== Conversion Summary ===\n")
-		fmt.Printf("✅ Added Keiyoushi extension repository to backup\n")
-		fmt.Printf("✅ Converted %d manga entries\n", len(b.BackupManga))
-		fmt.Printf("✅ Found %d unique sources\n\n", len(b.BackupSources))
-
-		fmt.Printf("📋 Sources in this backup:\n")
-		for i, src := range b.BackupSources {
-			fmt.Printf("   %d. %s (Source ID: %d)\n", i+1, src.GetName(), src.GetSourceId())
-		}
-
-		fmt.Printf("\n" + strings.Repeat("=", 60) + "\n")
-		fmt.Printf("📱 HOW TO USE THIS BACKUP IN MIHON:\n")
-		fmt.Printf(strings.Repeat("=", 60) + "\n\n")
-		fmt.Printf("STEP 1: Restore the backup\n")
-		fmt.Printf("   • Open Mihon → Settings → Backup and restore\n")
-		fmt.Printf("   • Select 'Restore backup' and choose the .tachibk file\n")
-		fmt.Printf("   • The Keiyoushi extension repo will be automatically added\n\n")
-
-		fmt.Printf("STEP 2: Install required extensions\n")
-		fmt.Printf("   • Open Mihon → Browse → Extensions tab\n")
-		fmt.Printf("   • You'll see the sources list above\n")
-		fmt.Printf("   • Search for each source name and install its extension\n")
-		fmt.Printf("   • Extensions are automatically trusted from Keiyoushi repo\n\n")
-
-		fmt.Printf("STEP 3: Verify your manga\n")
-		fmt.Printf("   • Go to Library tab\n")
-		fmt.Printf("   • Your manga should now be readable\n")
-		fmt.Printf("   • Tap any manga to verify chapters are available\n\n")
-
-		fmt.Printf("💡 TIP: Extension names usually match source names\n")
-		fmt.Printf("   Example: 'MangaDex' source → install 'MangaDex' extension\n\n")
-		fmt.Printf(strings.Repeat("=", 60) + "\n\n")
-	} // Filter out any sources/mangas that are not available in Mihon
+		report.ExtensionRepoAdded = true
+	}
+
+	// Mihon chapters have no page-level bookmarks and the reader grid is Kotatsu specific;
+	// settings with a Mihon equivalent become app preferences
+	if len(kb.Bookmarks) > 0 {
+		report.UnmappedFields["bookmarks"] += len(kb.Bookmarks)
+	}
+	if len(kb.RawSettings) > 0 {
+		prefs, untranslated, err := kotatsuSettingsToMihon(kb.RawSettings)
+		if err != nil {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("settings not converted: %v", err))
+			report.unmapped("settings")
+		} else {
+			b.BackupPreferences = prefs
+			report.UntranslatedPreferences = append(report.UntranslatedPreferences, untranslated...)
+			if len(untranslated) > 0 {
+				report.UnmappedFields["settings"] += len(untranslated)
+			}
+		}
+	}
+	if len(kb.RawReaderGrid) > 0 {
+		report.unmapped("reader_grid")
+	}
+
+	// Filter out any sources/mangas that are not available in Mihon
 	// pass kb.RawSources (may be empty) so the filter can attempt to read kotatsu-provided list
-	FilterBackupToCommon(b, kb.RawSources)
+	report.applyPlan(PlanFilterBackupToCommon(b, kb.RawSources), b, opts.Unmapped)
+
+	// Summarize the sources that survived filtering
+	mangaPerSource := make(map[int64]int)
+	for _, m := range b.BackupManga {
+		mangaPerSource[m.GetSource()]++
+	}
+	// a dry run hashes every source; without fallback a real run stops at the first of them
+	if opts.DryRun && !(Options{AllowSourceFallback: opts.AllowSourceFallback, Unmapped: opts.Unmapped}).allowFallback() && len(report.Fallbacks) > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("sources without a known mapping (%s) stop the conversion unless --allow-fallback or --unmapped keep|category|quarantine is given", strings.Join(report.Fallbacks, ", ")))
+	}
+	// only sources still in the backup need reassigning
+	report.Fallbacks = slices.DeleteFunc(report.Fallbacks, func(source string) bool { return mangaPerSource[sourceMap[source]] == 0 })
+	kotatsuBySourceID := make(map[int64]string, len(sourceMap))
+	for k, id := range sourceMap {
+		kotatsuBySourceID[id] = k
+	}
+	for _, src := range b.BackupSources {
+		pkg, _ := GetExtensionForSource(src.GetSourceId())
+		report.Sources = append(report.Sources, ReportSource{
+			Name:       src.GetName(),
+			ID:         src.GetSourceId(),
+			Kotatsu:    kotatsuBySourceID[src.GetSourceId()],
+			MangaCount: mangaPerSource[src.GetSourceId()],
+			Extension:  pkg,
+		})
+	}
+	report.ConvertedManga = len(b.BackupManga)
 
-	return b, nil
+	return b, report, nil
 }
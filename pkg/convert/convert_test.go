@@ -0,0 +1,77 @@
+package convert
+
+import (
+	"testing"
+
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+)
+
+func testMihonManga(source int64, url string, chapters ...*pb.BackupChapter) *pb.BackupManga {
+	return &pb.BackupManga{
+		Source:   int64Ptr(source),
+		Url:      stringPtr(url),
+		Title:    stringPtr("Manga " + url),
+		Chapters: chapters,
+	}
+}
+
+func testMihonChapter(url string, sourceOrder int64, read bool, lastPage int64) *pb.BackupChapter {
+	return &pb.BackupChapter{
+		Url:          stringPtr(url),
+		Name:         stringPtr("Chapter " + url),
+		Read:         boolPtr(read),
+		LastPageRead: int64Ptr(lastPage),
+		SourceOrder:  int64Ptr(sourceOrder),
+	}
+}
+
+func TestReadProgressRoundTrip(t *testing.T) {
+	sourceID, _ := KnownSourceMapping["MANGAPARK"].SourceID()
+	tests := []struct {
+		name        string
+		currentRead bool
+		want        []bool // oldest chapter first
+	}{
+		{"current chapter finished", true, []bool{true, true, false}},
+		{"current chapter in progress", false, []bool{true, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Mihon's sourceOrder counts from the newest chapter
+			m := testMihonManga(sourceID, "/title/1",
+				testMihonChapter("/c/3", 0, false, 0),
+				testMihonChapter("/c/2", 1, tt.currentRead, 7),
+				testMihonChapter("/c/1", 2, true, 0),
+			)
+			m.History = []*pb.BackupHistory{{Url: stringPtr("/c/2"), LastRead: int64Ptr(1000)}}
+			b := &pb.Backup{
+				BackupManga:   []*pb.BackupManga{m},
+				BackupSources: []*pb.BackupSource{{SourceId: int64Ptr(sourceID), Name: stringPtr("MangaPark")}},
+			}
+
+			kb, _ := MihonToKotatsu(b, Options{})
+			if len(kb.History) != 1 {
+				t.Fatalf("got %d history entries, want 1", len(kb.History))
+			}
+			back, _, err := KotatsuToMihon(kb, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(back.BackupManga) != 1 {
+				t.Fatalf("got %d manga, want 1", len(back.BackupManga))
+			}
+			chapters := back.BackupManga[0].Chapters
+			if len(chapters) != len(tt.want) {
+				t.Fatalf("got %d chapters, want %d", len(chapters), len(tt.want))
+			}
+			for i, c := range chapters {
+				if c.GetRead() != tt.want[i] {
+					t.Errorf("chapter %s: read = %v, want %v", c.GetUrl(), c.GetRead(), tt.want[i])
+				}
+			}
+			if got := chapters[1].GetLastPageRead(); got != 7 {
+				t.Errorf("current chapter last page = %d, want 7", got)
+			}
+		})
+	}
+}
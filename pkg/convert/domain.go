@@ -0,0 +1,261 @@
+package convert
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/galpt/mk-bkconv/pkg/kotatsu"
+)
+
+// Confidence of a DomainMatch
+const (
+	// ConfidenceExact: same host and language
+	ConfidenceExact = 1.0
+	// ConfidenceHost: same host, language could not be confirmed
+	ConfidenceHost = 0.8
+	// ConfidenceMirror: same site name on another domain (e.g. a .to mirror of a .com site)
+	ConfidenceMirror = 0.5
+)
+
+// DomainMatch is a Kotatsu source matched to a Mihon source by website domain
+type DomainMatch struct {
+	Kotatsu    string  `json:"kotatsu"`
+	MihonName  string  `json:"mihon_name"`
+	MihonLang  string  `json:"mihon_lang"`
+	SourceID   int64   `json:"source_id"`
+	Host       string  `json:"host"`
+	Confidence float64 `json:"confidence"`
+	Reason     string  `json:"reason"`
+	// Applied is false for matches below Options.MinDomainConfidence, which are only reported
+	Applied bool `json:"applied"`
+}
+
+// langPathPattern matches language path segments such as "en" or "pt-br"
+var langPathPattern = regexp.MustCompile(`^[a-z]{2}([-_][a-z]{2,4})?$`)
+
+// hostPrefixes are subdomains that do not identify a different site
+var hostPrefixes = []string{"www.", "www2.", "m.", "mobile."}
+
+// sharedHostSuffixes are hosting domains whose subdomains are unrelated sites,
+// so they are never matched as mirrors of each other
+var sharedHostSuffixes = []string{
+	"blogspot.com", "wordpress.com", "github.io", "gitlab.io", "netlify.app",
+	"vercel.app", "pages.dev", "workers.dev", "herokuapp.com", "web.app",
+	"firebaseapp.com", "wixsite.com", "weebly.com", "tumblr.com", "neocities.org",
+}
+
+// onSharedHost reports whether host is a subdomain of a shared hosting domain
+func onSharedHost(host string) bool {
+	for _, suffix := range sharedHostSuffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeURL returns the host of a URL without port and www/mobile prefixes,
+// and the language path segment if the URL starts with one
+func normalizeURL(raw string) (host, langPath string) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", ""
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + strings.TrimPrefix(raw, "//")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", ""
+	}
+	host = strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	for stripped := true; stripped; {
+		stripped = false
+		for _, p := range hostPrefixes {
+			if strings.HasPrefix(host, p) && strings.Count(host, ".") > 1 {
+				host = strings.TrimPrefix(host, p)
+				stripped = true
+			}
+		}
+	}
+	segment, _, _ := strings.Cut(strings.TrimPrefix(strings.ToLower(u.Path), "/"), "/")
+	if langPathPattern.MatchString(segment) {
+		langPath = strings.ReplaceAll(segment, "_", "-")
+	}
+	return host, langPath
+}
+
+// siteName returns the registrable name of a host without its public suffix,
+// e.g. "mangafire" for both "mangafire.to" and "mangafire.co.uk"
+func siteName(host string) string {
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return host
+	}
+	labels = labels[:len(labels)-1]
+	if n := len(labels); n >= 2 {
+		switch labels[n-1] {
+		case "co", "com", "net", "org", "ac":
+			labels = labels[:n-1]
+		}
+	}
+	return labels[len(labels)-1]
+}
+
+// kotatsuLangHint extracts the language suffix of a Kotatsu parser name, e.g. "en" for MANGAFIRE_EN
+func kotatsuLangHint(source string) string {
+	i := strings.LastIndexByte(source, '_')
+	if i < 0 {
+		return ""
+	}
+	suffix := strings.ToLower(source[i+1:])
+	if len(suffix) == 2 {
+		return suffix
+	}
+	return ""
+}
+
+// DomainResolver matches website URLs against the base URLs in KeiyoushiIndex
+type DomainResolver struct {
+	byHost map[string][]SourceInExtension
+	byName map[string][]SourceInExtension
+}
+
+// NewDomainResolver indexes the current KeiyoushiIndex by host and site name
+func NewDomainResolver() *DomainResolver {
+	r := &DomainResolver{
+		byHost: make(map[string][]SourceInExtension),
+		byName: make(map[string][]SourceInExtension),
+	}
+	seen := make(map[int64]struct{})
+	for _, ext := range KeiyoushiIndex {
+		for _, s := range ext.Sources {
+			if _, ok := seen[s.ID]; ok {
+				continue
+			}
+			seen[s.ID] = struct{}{}
+			host, _ := normalizeURL(s.BaseURL)
+			if host == "" {
+				continue
+			}
+			r.byHost[host] = append(r.byHost[host], s)
+			if !onSharedHost(host) {
+				name := siteName(host)
+				r.byName[name] = append(r.byName[name], s)
+			}
+		}
+	}
+	// map iteration order is random, keep candidate order stable
+	for _, m := range []map[string][]SourceInExtension{r.byHost, r.byName} {
+		for _, candidates := range m {
+			sort.Slice(candidates, func(i, j int) bool {
+				if candidates[i].Name != candidates[j].Name {
+					return candidates[i].Name < candidates[j].Name
+				}
+				return candidates[i].Lang < candidates[j].Lang
+			})
+		}
+	}
+	return r
+}
+
+// Resolve finds the Mihon source serving publicURL. langHint (which may be empty)
+// is used when the URL carries no language path.
+func (r *DomainResolver) Resolve(publicURL, langHint string) (DomainMatch, bool) {
+	host, langPath := normalizeURL(publicURL)
+	if host == "" {
+		return DomainMatch{}, false
+	}
+	lang := langHint
+	if langPath != "" {
+		lang = langPath
+	}
+
+	confidence, reason := ConfidenceExact, "same host"
+	candidates := r.byHost[host]
+	if len(candidates) == 0 && !onSharedHost(host) {
+		candidates = r.byName[siteName(host)]
+		confidence, reason = ConfidenceMirror, "mirror domain of "+siteName(host)
+	}
+	if len(candidates) == 0 {
+		return DomainMatch{}, false
+	}
+
+	chosen, langMatched := pickByLang(candidates, lang)
+	if !langMatched {
+		if confidence == ConfidenceExact {
+			confidence = ConfidenceHost
+		}
+		reason += ", language not confirmed"
+	} else if lang != "" {
+		reason += ", language " + lang
+	}
+	return DomainMatch{
+		MihonName:  chosen.Name,
+		MihonLang:  chosen.Lang,
+		SourceID:   chosen.ID,
+		Host:       host,
+		Confidence: confidence,
+		Reason:     reason,
+	}, true
+}
+
+// pickByLang picks the candidate for lang: an exact language match, then the
+// multi-language "all" source, then the first candidate. matched reports whether
+// the language is certain, which it is not for the last fallback.
+func pickByLang(candidates []SourceInExtension, lang string) (chosen SourceInExtension, matched bool) {
+	if lang != "" {
+		for _, c := range candidates {
+			if strings.EqualFold(c.Lang, lang) {
+				return c, true
+			}
+		}
+		primary, _, _ := strings.Cut(lang, "-")
+		for _, c := range candidates {
+			if p, _, _ := strings.Cut(c.Lang, "-"); strings.EqualFold(p, primary) {
+				return c, true
+			}
+		}
+	}
+	for _, c := range candidates {
+		if c.Lang == "all" {
+			return c, true
+		}
+	}
+	return candidates[0], false
+}
+
+// matchSourcesByDomain resolves the Kotatsu sources of favourites that have no
+// KnownSourceMapping entry by their manga's public URLs. The most confident match
+// per source wins.
+func matchSourcesByDomain(favourites []kotatsu.KotatsuFavouriteEntry) map[string]DomainMatch {
+	matches := make(map[string]DomainMatch)
+	if len(KeiyoushiIndex) == 0 {
+		return matches
+	}
+	resolver := NewDomainResolver()
+	for _, fav := range favourites {
+		km := fav.Manga
+		if km.Source == "" || km.PublicUrl == "" {
+			continue
+		}
+		if _, mapped := KnownSourceMapping[km.Source]; mapped {
+			continue
+		}
+		if best, ok := matches[km.Source]; ok && best.Confidence == ConfidenceExact {
+			continue
+		}
+		match, ok := resolver.Resolve(km.PublicUrl, kotatsuLangHint(km.Source))
+		if !ok {
+			continue
+		}
+		if best, ok := matches[km.Source]; ok && best.Confidence >= match.Confidence {
+			continue
+		}
+		match.Kotatsu = km.Source
+		matches[km.Source] = match
+	}
+	return matches
+}
@@ -1,5 +1,16 @@
 package convert
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
 // ExtensionMetadata represents information about a Mihon extension
 type ExtensionMetadata struct {
 	PackageName string // e.g., "eu.kanade.tachiyomi.extension.en.mangadex"
@@ -17,14 +28,101 @@ type SourceInExtension struct {
 	BaseURL string // e.g., "https://mangadex.org"
 }
 
-// KeiyoushiIndex caches the Keiyoushi extension index
-// In a production tool, this would be fetched from:
+// KeiyoushiIndex maps source IDs to the extension providing them. It is empty
+// until a caller installs a copy of
 // https://raw.githubusercontent.com/keiyoushi/extensions/repo/index.min.json
-// and cached locally or embedded in the binary
-var KeiyoushiIndex = map[int64]ExtensionMetadata{
-	// This would be populated from the index.min.json
-	// For now, we'll use the known mappings approach
-	// TODO: Implement index fetching and parsing
+// read with LoadKeiyoushiIndex through SetKeiyoushiIndex; no snapshot is built
+// into the package.
+var KeiyoushiIndex map[int64]ExtensionMetadata
+
+// keiyoushiSourcesByName indexes KeiyoushiIndex by name and language for FindIndexedSource
+var keiyoushiSourcesByName map[indexKey]SourceInExtension
+
+// SetKeiyoushiIndex installs idx as KeiyoushiIndex and indexes its sources by
+// name and language
+func SetKeiyoushiIndex(idx map[int64]ExtensionMetadata) {
+	KeiyoushiIndex = idx
+	keiyoushiSourcesByName = buildSourcesByName(idx)
+}
+
+// DefaultExtensionIndexFile returns where the CLI looks for a saved index.min.json:
+// <user cache dir>/mk-bkconv/index.min.json
+func DefaultExtensionIndexFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mk-bkconv", "index.min.json")
+}
+
+// indexExtension is one element of index.min.json
+type indexExtension struct {
+	Name    string        `json:"name"`
+	Pkg     string        `json:"pkg"`
+	Lang    string        `json:"lang"`
+	Version string        `json:"version"`
+	Sources []indexSource `json:"sources"`
+}
+
+type indexSource struct {
+	Name    string        `json:"name"`
+	Lang    string        `json:"lang"`
+	ID      indexSourceID `json:"id"`
+	BaseURL string        `json:"baseUrl"`
+}
+
+// indexSourceID accepts source IDs written as JSON strings (as the index does,
+// since they overflow JavaScript numbers) or as plain numbers
+type indexSourceID int64
+
+func (id *indexSourceID) UnmarshalJSON(data []byte) error {
+	s := string(bytes.Trim(data, `"`))
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("source id %s: %w", data, err)
+	}
+	*id = indexSourceID(v)
+	return nil
+}
+
+// LoadKeiyoushiIndex reads a locally saved index.min.json
+func LoadKeiyoushiIndex(path string) (map[int64]ExtensionMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadKeiyoushiIndex(f)
+}
+
+// ReadKeiyoushiIndex parses index.min.json into a map keyed by source ID
+func ReadKeiyoushiIndex(r io.Reader) (map[int64]ExtensionMetadata, error) {
+	var exts []indexExtension
+	if err := json.NewDecoder(r).Decode(&exts); err != nil {
+		return nil, fmt.Errorf("decode extension index: %w", err)
+	}
+	idx := make(map[int64]ExtensionMetadata)
+	for _, e := range exts {
+		meta := ExtensionMetadata{
+			PackageName: e.Pkg,
+			Name:        e.Name,
+			Lang:        e.Lang,
+			Version:     e.Version,
+			Sources:     make([]SourceInExtension, 0, len(e.Sources)),
+		}
+		for _, s := range e.Sources {
+			meta.Sources = append(meta.Sources, SourceInExtension{
+				Name:    s.Name,
+				Lang:    s.Lang,
+				ID:      int64(s.ID),
+				BaseURL: s.BaseURL,
+			})
+		}
+		for _, s := range meta.Sources {
+			idx[s.ID] = meta
+		}
+	}
+	return idx, nil
 }
 
 // GetExtensionForSource returns the extension package name for a given source ID
@@ -35,3 +133,50 @@ func GetExtensionForSource(sourceID int64) (packageName string, found bool) {
 	}
 	return ext.PackageName, true
 }
+
+// GetIndexedSource returns the index entry of a source ID
+func GetIndexedSource(sourceID int64) (SourceInExtension, bool) {
+	ext, found := KeiyoushiIndex[sourceID]
+	if !found {
+		return SourceInExtension{}, false
+	}
+	for _, s := range ext.Sources {
+		if s.ID == sourceID {
+			return s, true
+		}
+	}
+	return SourceInExtension{}, false
+}
+
+// indexKey identifies a source by lowercased name and language
+type indexKey struct {
+	name string
+	lang string
+}
+
+// buildSourcesByName indexes idx by (lowercased name, lang). When several
+// extensions publish the same name and language, the one with the smallest
+// package name wins, then the smallest source ID, so lookups are deterministic.
+func buildSourcesByName(idx map[int64]ExtensionMetadata) map[indexKey]SourceInExtension {
+	byName := make(map[indexKey]SourceInExtension)
+	pkgOf := make(map[indexKey]string)
+	for _, ext := range idx {
+		for _, s := range ext.Sources {
+			key := indexKey{strings.ToLower(s.Name), s.Lang}
+			prev, exists := byName[key]
+			if exists && (pkgOf[key] < ext.PackageName || pkgOf[key] == ext.PackageName && prev.ID <= s.ID) {
+				continue
+			}
+			byName[key] = s
+			pkgOf[key] = ext.PackageName
+		}
+	}
+	return byName
+}
+
+// FindIndexedSource looks up a source by name (case-insensitive) and language
+// in the index installed with SetKeiyoushiIndex
+func FindIndexedSource(name, lang string) (SourceInExtension, bool) {
+	s, found := keiyoushiSourcesByName[indexKey{strings.ToLower(name), lang}]
+	return s, found
+}
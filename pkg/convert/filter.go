@@ -1,68 +1,112 @@
 package convert
 
 import (
+	"bytes"
 	"encoding/json"
-	"os"
-	"path/filepath"
+	"fmt"
+	"slices"
 	"strings"
 
 	pb "github.com/galpt/mk-bkconv/proto/mihon"
 )
 
-// FilterBackupToCommon removes mangas and sources from the Mihon backup
-// that don't have matching sources available in both Kotatsu and Mihon.
-// It attempts to discover Mihon extension names from a references folder
-// (ENV "REFERENCES_ROOT" or ../references by default). If discovery fails
-// it falls back to KnownSourceMapping as a conservative whitelist.
-func FilterBackupToCommon(b *pb.Backup, kotatsuRawSources []byte) {
-	// Discover mihon sources from references (best-effort)
-	refRoot := os.Getenv("REFERENCES_ROOT")
-	if refRoot == "" {
-		// try relative ../references
-		cwd, err := os.Getwd()
-		if err == nil {
-			candidate := filepath.Join(cwd, "..", "..", "references")
-			if _, err := os.Stat(candidate); err == nil {
-				refRoot = candidate
-			}
+// discoverMihonNames returns lowercased Mihon source and extension names from
+// Catalog; without a catalog only KnownSourceMapping is known
+func discoverMihonNames() map[string]struct{} {
+	if Catalog == nil {
+		return map[string]struct{}{}
+	}
+	return Catalog.mihonSourceNames()
+}
+
+// discoverKotatsuNames returns lowercased Kotatsu parser names from Catalog;
+// without a catalog only KnownSourceMapping is known
+func discoverKotatsuNames() map[string]struct{} {
+	if Catalog == nil {
+		return map[string]struct{}{}
+	}
+	return Catalog.kotatsuParserNames()
+}
+
+// FilterPlan describes what a filter would remove from a backup without
+// touching it. Apply carries the plan out on the backup it was computed for.
+type FilterPlan struct {
+	// Dropped lists every manga that would be removed, with the mapping rule
+	// that would have been needed to keep it
+	Dropped []DroppedManga
+
+	// droppedOrder holds the manga behind each Dropped entry
+	droppedOrder []*pb.BackupManga
+	dropManga    map[*pb.BackupManga]struct{}
+	keepSources  map[int64]struct{}
+}
+
+// Apply removes the planned mangas and sources from b and returns the removed mangas
+func (p *FilterPlan) Apply(b *pb.Backup) []DroppedManga {
+	if p.keepSources == nil {
+		// nothing could be decided, keep the backup untouched
+		return nil
+	}
+	var kept []*pb.BackupManga
+	for _, m := range b.BackupManga {
+		if _, drop := p.dropManga[m]; !drop {
+			kept = append(kept, m)
+		}
+	}
+	b.BackupManga = kept
+
+	var keptSources []*pb.BackupSource
+	for _, s := range b.BackupSources {
+		if _, ok := p.keepSources[s.GetSourceId()]; ok {
+			keptSources = append(keptSources, s)
 		}
 	}
+	b.BackupSources = keptSources
+	return p.Dropped
+}
+
+func (p *FilterPlan) drop(m *pb.BackupManga, sourceName, reason, rule string) {
+	d := droppedManga(m, sourceName, reason)
+	d.Rule = rule
+	p.Dropped = append(p.Dropped, d)
+	p.droppedOrder = append(p.droppedOrder, m)
+	p.dropManga[m] = struct{}{}
+}
+
+func newFilterPlan() *FilterPlan {
+	return &FilterPlan{
+		dropManga:   make(map[*pb.BackupManga]struct{}),
+		keepSources: make(map[int64]struct{}),
+	}
+}
+
+// FilterBackupToCommon removes mangas and sources from the Mihon backup
+// that don't have matching sources available in both Kotatsu and Mihon.
+// It discovers Mihon extension names from Catalog (see ScanSources); without a
+// catalog it falls back to KnownSourceMapping as a conservative whitelist.
+// The removed mangas are returned.
+func FilterBackupToCommon(b *pb.Backup, kotatsuRawSources []byte) []DroppedManga {
+	return PlanFilterBackupToCommon(b, kotatsuRawSources).Apply(b)
+}
 
+// PlanFilterBackupToCommon computes what FilterBackupToCommon would remove without modifying b.
+func PlanFilterBackupToCommon(b *pb.Backup, kotatsuRawSources []byte) *FilterPlan {
 	mihonNames := make(map[string]struct{})
 	// Seed from KnownSourceMapping values (guaranteed known mappings)
 	for _, m := range KnownSourceMapping {
 		mihonNames[strings.ToLower(m.MihonName)] = struct{}{}
 	}
-
-	// If we have a references root, try to walk and discover extension directories
-	if refRoot != "" {
-		_ = filepath.Walk(refRoot, func(path string, info os.FileInfo, err error) error {
-			if err != nil || info.IsDir() {
-				return nil
-			}
-			// look for Kotlin/Java extension files path that include the tachiyomi extension package
-			p := filepath.ToSlash(path)
-			if strings.Contains(p, "/eu/kanade/tachiyomi/extension/") && strings.HasSuffix(p, ".kt") {
-				// attempt to extract extension short name (the parent folder under extension)
-				parts := strings.Split(p, "/eu/kanade/tachiyomi/extension/")
-				if len(parts) > 1 {
-					rest := parts[1]
-					segs := strings.Split(rest, "/")
-					if len(segs) > 0 {
-						mihonNames[strings.ToLower(segs[0])] = struct{}{}
-					}
-				}
-			}
-			return nil
-		})
+	for name := range discoverMihonNames() {
+		mihonNames[name] = struct{}{}
 	}
 
-	// Build allowed ID set from mihonNames using GenerateMihonSourceID where possible
+	// Build allowed ID set from mihonNames using each mapping's source ID
 	allowedIDs := make(map[int64]struct{})
 	for _, m := range KnownSourceMapping {
 		if _, ok := mihonNames[strings.ToLower(m.MihonName)]; ok {
-			id := GenerateMihonSourceID(m.MihonName, m.MihonLang, m.MihonVersionID)
-			allowedIDs[id] = struct{}{}
+			for _, id := range m.knownSourceIDs() {
+				allowedIDs[id] = struct{}{}
+			}
 		}
 	}
 
@@ -83,94 +127,102 @@ func FilterBackupToCommon(b *pb.Backup, kotatsuRawSources []byte) {
 	if len(allowedIDs) == 0 {
 		for k := range KnownSourceMapping {
 			m := KnownSourceMapping[k]
-			id := GenerateMihonSourceID(m.MihonName, m.MihonLang, m.MihonVersionID)
-			allowedIDs[id] = struct{}{}
+			for _, id := range m.knownSourceIDs() {
+				allowedIDs[id] = struct{}{}
+			}
 		}
 	}
 
-	// Filter BackupManga entries: keep only those whose Source ID is in allowedIDs
-	var kept []*pb.BackupManga
+	// Sources published in the extension index (e.g. matched by domain) or found by a scan exist in Mihon
+	for id := range KeiyoushiIndex {
+		allowedIDs[id] = struct{}{}
+	}
+	if Catalog != nil {
+		for _, src := range Catalog.MihonSources {
+			allowedIDs[src.SourceID()] = struct{}{}
+		}
+	}
+
+	sourceNames := make(map[int64]string, len(b.BackupSources))
+	for _, s := range b.BackupSources {
+		sourceNames[s.GetSourceId()] = s.GetName()
+	}
+
+	// Plan BackupManga entries: keep only those whose Source ID is in allowedIDs
+	plan := newFilterPlan()
 	for _, m := range b.BackupManga {
 		if _, ok := allowedIDs[m.GetSource()]; ok {
-			kept = append(kept, m)
 			continue
 		}
 		// If source not by id, try to match by name from BackupSources
-		foundByName := false
-		for _, s := range b.BackupSources {
-			if s.GetSourceId() == m.GetSource() {
-				if s.GetName() != "" {
-					if _, ok := mihonNames[strings.ToLower(s.GetName())]; ok {
-						foundByName = true
-						break
-					}
-				}
+		name := sourceNames[m.GetSource()]
+		if name != "" {
+			if _, ok := mihonNames[strings.ToLower(name)]; ok {
+				continue
 			}
 		}
-		if foundByName {
-			kept = append(kept, m)
-		}
+		plan.drop(m, name, "source is not available in Mihon", neededMihonRule(name))
 	}
-	b.BackupManga = kept
 
-	// Filter BackupSources similarly
-	var keptSources []*pb.BackupSource
+	// Plan BackupSources similarly
 	for _, s := range b.BackupSources {
 		if _, ok := allowedIDs[s.GetSourceId()]; ok {
-			keptSources = append(keptSources, s)
+			plan.keepSources[s.GetSourceId()] = struct{}{}
 			continue
 		}
 		if s.GetName() != "" {
 			if _, ok := mihonNames[strings.ToLower(s.GetName())]; ok {
-				keptSources = append(keptSources, s)
+				plan.keepSources[s.GetSourceId()] = struct{}{}
 			}
 		}
 	}
-	b.BackupSources = keptSources
+	return plan
 }
 
-// FilterMihonForKotatsu removes Mihon backup entries that don't have a corresponding
-// Kotatsu source available. It attempts to discover Kotatsu parser names from
-// references (ENV "REFERENCES_ROOT" or ../references by default) and falls back
-// to KnownSourceMapping keys if discovery fails.
-func FilterMihonForKotatsu(b *pb.Backup) {
-	refRoot := os.Getenv("REFERENCES_ROOT")
-	if refRoot == "" {
-		cwd, err := os.Getwd()
-		if err == nil {
-			candidate := filepath.Join(cwd, "..", "..", "references")
-			if _, err := os.Stat(candidate); err == nil {
-				refRoot = candidate
-			}
+// neededMihonRule describes the mapping that would let a Kotatsu source through FilterBackupToCommon.
+// Unmapped sources carry their Kotatsu name in BackupSources.
+func neededMihonRule(sourceName string) string {
+	if sourceName == "" {
+		return "a BackupSources entry naming this source"
+	}
+	for _, k := range knownSourceKeys() {
+		m := KnownSourceMapping[k]
+		if strings.EqualFold(m.MihonName, sourceName) {
+			return fmt.Sprintf("Mihon extension %q (mapped from %s) must be in the source catalog (mk-bkconv sources scan)", m.MihonName, k)
 		}
 	}
+	return mappingFileRule(sourceName, "<Mihon source name>", "<lang>")
+}
+
+// mappingFileRule describes the --mapping file entry mapping key to a Mihon source
+func mappingFileRule(key, mihonName, mihonLang string) string {
+	return fmt.Sprintf(`add %s: {"mihon_name": %s, "mihon_lang": %s} to the --mapping file`, jsonString(key), jsonString(mihonName), jsonString(mihonLang))
+}
+
+func jsonString(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
 
+// FilterMihonForKotatsu removes Mihon backup entries that don't have a corresponding
+// Kotatsu source available. It discovers Kotatsu parser names from Catalog and
+// falls back to KnownSourceMapping keys without a catalog. The removed mangas are returned.
+func FilterMihonForKotatsu(b *pb.Backup) []DroppedManga {
+	return PlanFilterMihonForKotatsu(b).Apply(b)
+}
+
+// PlanFilterMihonForKotatsu computes what FilterMihonForKotatsu would remove without modifying b.
+func PlanFilterMihonForKotatsu(b *pb.Backup) *FilterPlan {
 	kotatsuNames := make(map[string]struct{})
 	// Seed from KnownSourceMapping keys
 	for k := range KnownSourceMapping {
 		kotatsuNames[strings.ToLower(k)] = struct{}{}
 	}
-
-	if refRoot != "" {
-		// look for kotatsu-parsers-master repo
-		_ = filepath.Walk(refRoot, func(path string, info os.FileInfo, err error) error {
-			if err != nil || !info.IsDir() {
-				return nil
-			}
-			p := filepath.ToSlash(path)
-			// match paths like .../kotatsu-parsers-master/src/main/kotlin/.../site/<sourcename>
-			if strings.Contains(p, "/kotatsu-parsers-master/src/main/kotlin/") && strings.Contains(p, "/site/") {
-				// extract after /site/
-				parts := strings.Split(p, "/site/")
-				if len(parts) > 1 {
-					segs := strings.Split(parts[1], "/")
-					if len(segs) > 0 && segs[0] != "" {
-						kotatsuNames[strings.ToLower(segs[0])] = struct{}{}
-					}
-				}
-			}
-			return nil
-		})
+	for name := range discoverKotatsuNames() {
+		kotatsuNames[name] = struct{}{}
 	}
 
 	// Build allowed Mihon IDs for kotatsu-supported sources via KnownSourceMapping
@@ -178,30 +230,64 @@ func FilterMihonForKotatsu(b *pb.Backup) {
 	for k := range KnownSourceMapping {
 		if _, ok := kotatsuNames[strings.ToLower(k)]; ok {
 			m := KnownSourceMapping[k]
-			id := GenerateMihonSourceID(m.MihonName, m.MihonLang, m.MihonVersionID)
-			allowedIDs[id] = struct{}{}
+			for _, id := range m.knownSourceIDs() {
+				allowedIDs[id] = struct{}{}
+			}
 		}
 	}
 
 	// If allowedIDs empty, keep existing backup untouched (conservative)
 	if len(allowedIDs) == 0 {
-		return
+		return &FilterPlan{}
 	}
 
-	// Filter BackupManga and BackupSources
-	var kept []*pb.BackupManga
+	sourceNames := make(map[int64]string, len(b.BackupSources))
+	for _, s := range b.BackupSources {
+		sourceNames[s.GetSourceId()] = s.GetName()
+	}
+
+	// Plan BackupManga and BackupSources
+	plan := newFilterPlan()
 	for _, m := range b.BackupManga {
 		if _, ok := allowedIDs[m.GetSource()]; ok {
-			kept = append(kept, m)
+			continue
 		}
+		name := sourceNames[m.GetSource()]
+		plan.drop(m, name, "no Kotatsu parser is known for this source", neededKotatsuRule(m.GetSource(), name))
 	}
-	b.BackupManga = kept
 
-	var keptSources []*pb.BackupSource
 	for _, s := range b.BackupSources {
 		if _, ok := allowedIDs[s.GetSourceId()]; ok {
-			keptSources = append(keptSources, s)
+			plan.keepSources[s.GetSourceId()] = struct{}{}
 		}
 	}
-	b.BackupSources = keptSources
+	return plan
+}
+
+// neededKotatsuRule describes the mapping that would let a Mihon source through FilterMihonForKotatsu
+func neededKotatsuRule(sourceID int64, sourceName string) string {
+	for _, k := range knownSourceKeys() {
+		m := KnownSourceMapping[k]
+		if slices.Contains(m.knownSourceIDs(), sourceID) {
+			return fmt.Sprintf("Kotatsu parser %s must be in the source catalog (mk-bkconv sources scan)", k)
+		}
+	}
+	lang := "<lang>"
+	if s, ok := GetIndexedSource(sourceID); ok {
+		sourceName, lang = s.Name, s.Lang
+	}
+	if sourceName == "" {
+		sourceName = "<source name>"
+	}
+	return fmt.Sprintf("%s (source ID %d)", mappingFileRule("<KOTATSU_PARSER>", sourceName, lang), sourceID)
+}
+
+func droppedManga(m *pb.BackupManga, sourceName, reason string) DroppedManga {
+	return DroppedManga{
+		Title:    m.GetTitle(),
+		Url:      m.GetUrl(),
+		SourceID: m.GetSource(),
+		Source:   sourceName,
+		Reason:   reason,
+	}
 }
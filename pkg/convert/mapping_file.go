@@ -0,0 +1,170 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// MappingFileEnv names the environment variable pointing at a source mapping file
+const MappingFileEnv = "MK_BKCONV_MAPPING"
+
+// DefaultMappingFile returns the mapping file looked up when neither a flag nor
+// MappingFileEnv is set: <user config dir>/mk-bkconv/mappings.json
+func DefaultMappingFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mk-bkconv", "mappings.json")
+}
+
+// MappingEntryError reports a problem with a single entry of a mapping file
+type MappingEntryError struct {
+	Key string
+	Err error
+}
+
+func (e *MappingEntryError) Error() string {
+	return fmt.Sprintf("mapping %q: %v", e.Key, e.Err)
+}
+
+func (e *MappingEntryError) Unwrap() error { return e.Err }
+
+// LoadSourceMappings reads a JSON mapping file of the form
+//
+//	{"KOTATSU_KEY": {"mihon_name": "Name", "mihon_lang": "en", "mihon_version_id": 1, "notes": ""}}
+//
+// An entry may carry a "urls" object (see URLTransform) to rewrite URLs.
+// mihon_lang defaults to "all" and mihon_version_id to 1.
+// Valid entries are returned even when others fail validation.
+// Each invalid entry is reported as a *MappingEntryError in entryErrs.
+// err is only set when the file itself cannot be read.
+func LoadSourceMappings(path string) (mappings map[string]SourceMapping, entryErrs []error, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	return ReadSourceMappings(f)
+}
+
+// ReadSourceMappings is LoadSourceMappings for an arbitrary reader
+func ReadSourceMappings(r io.Reader) (mappings map[string]SourceMapping, entryErrs []error, err error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, nil, fmt.Errorf("decode mapping file: %w", err)
+	}
+
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	mappings = make(map[string]SourceMapping, len(raw))
+	for _, k := range keys {
+		m, err := decodeMappingEntry(k, raw[k])
+		if err != nil {
+			entryErrs = append(entryErrs, &MappingEntryError{Key: k, Err: err})
+			continue
+		}
+		mappings[k] = m
+	}
+	return mappings, entryErrs, nil
+}
+
+func decodeMappingEntry(key string, raw json.RawMessage) (SourceMapping, error) {
+	if key == "" {
+		return SourceMapping{}, errors.New("empty Kotatsu source key")
+	}
+	var entry struct {
+		MihonName      string        `json:"mihon_name"`
+		MihonLang      string        `json:"mihon_lang"`
+		MihonVersionID *int          `json:"mihon_version_id"`
+		Notes          string        `json:"notes"`
+		URLs           *URLTransform `json:"urls"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entry); err != nil {
+		return SourceMapping{}, err
+	}
+	if entry.MihonName == "" {
+		return SourceMapping{}, errors.New("mihon_name is required")
+	}
+	m := SourceMapping{
+		MihonName:      entry.MihonName,
+		MihonLang:      entry.MihonLang,
+		MihonVersionID: 1,
+		Notes:          entry.Notes,
+		URLs:           entry.URLs,
+	}
+	if m.URLs != nil {
+		if err := m.URLs.Validate(); err != nil {
+			return SourceMapping{}, fmt.Errorf("urls: %w", err)
+		}
+	}
+	if m.MihonLang == "" {
+		m.MihonLang = "all"
+	}
+	if entry.MihonVersionID != nil {
+		if *entry.MihonVersionID < 1 {
+			return SourceMapping{}, fmt.Errorf("mihon_version_id must be at least 1, got %d", *entry.MihonVersionID)
+		}
+		m.MihonVersionID = *entry.MihonVersionID
+	}
+	return m, nil
+}
+
+// MergeSourceMappings returns a copy of base with the entries of overrides added
+// or replaced; neither map is modified. Callers install the result with
+// KnownSourceMapping = MergeSourceMappings(KnownSourceMapping, entries).
+func MergeSourceMappings(base, overrides map[string]SourceMapping) map[string]SourceMapping {
+	merged := make(map[string]SourceMapping, len(base)+len(overrides))
+	for k, m := range base {
+		merged[k] = m
+	}
+	for k, m := range overrides {
+		merged[k] = m
+	}
+	return merged
+}
+
+// MappingListEntry is one row of the effective mapping table
+type MappingListEntry struct {
+	KotatsuKey     string `json:"kotatsu_key"`
+	MihonName      string `json:"mihon_name"`
+	MihonLang      string `json:"mihon_lang"`
+	MihonVersionID int    `json:"mihon_version_id"`
+	MihonSourceID  int64  `json:"mihon_source_id"`
+	// IDFromIndex is set when MihonSourceID was published in KeiyoushiIndex rather than computed
+	IDFromIndex bool   `json:"id_from_index"`
+	Notes       string `json:"notes,omitempty"`
+}
+
+// EffectiveMappings returns the current KnownSourceMapping (built-in entries
+// merged with any loaded file) sorted by Kotatsu key
+func EffectiveMappings() []MappingListEntry {
+	keys := knownSourceKeys()
+	out := make([]MappingListEntry, 0, len(keys))
+	for _, k := range keys {
+		m := KnownSourceMapping[k]
+		id, published := m.SourceID()
+		out = append(out, MappingListEntry{
+			KotatsuKey:     k,
+			MihonName:      m.MihonName,
+			MihonLang:      m.MihonLang,
+			MihonVersionID: m.MihonVersionID,
+			MihonSourceID:  id,
+			IDFromIndex:    published,
+			Notes:          m.Notes,
+		})
+	}
+	return out
+}
@@ -0,0 +1,554 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/galpt/mk-bkconv/pkg/kotatsu"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+	"google.golang.org/protobuf/proto"
+)
+
+// MergeReport describes what MergeMihonBackups or MergeKotatsuBackups did
+type MergeReport struct {
+	Inputs     int `json:"inputs"`
+	Manga      int `json:"manga"`
+	Duplicates int `json:"duplicates"` // manga found in more than one backup and merged
+	Categories int `json:"categories"`
+	// Conflicts lists duplicate manga whose metadata differed; the newer copy was kept
+	Conflicts []MergeConflict `json:"conflicts"`
+}
+
+// MergeConflict is a manga whose copies disagreed
+type MergeConflict struct {
+	Title    string `json:"title"`
+	Url      string `json:"url"`
+	SourceID int64  `json:"source_id,omitempty"` // Mihon backups
+	Source   string `json:"source,omitempty"`    // Kotatsu backups
+	Kept     int    `json:"kept"`                // index of the input whose metadata was kept
+	Reason   string `json:"reason"`
+}
+
+type mangaKey struct {
+	source int64
+	url    string
+}
+
+// categoryResolver maps the values in BackupManga.Categories of one backup to
+// category names. Mihon references categories by order.
+func categoryResolver(b *pb.Backup) func(int64) (string, bool) {
+	names := make(map[int64]string, len(b.BackupCategories))
+	for _, c := range b.BackupCategories {
+		if _, dup := names[c.GetOrder()]; !dup {
+			names[c.GetOrder()] = c.GetName()
+		}
+	}
+	return func(v int64) (string, bool) {
+		name, ok := names[v]
+		return name, ok
+	}
+}
+
+// MergeMihonBackups combines backups into one library. Manga are deduplicated by
+// (source, url) and categories by name. For duplicate manga a chapter counts as
+// read when it is read in any copy, the latest history entry per chapter wins,
+// metadata comes from the copy with the newest lastModifiedAt and the favourite
+// flag from the copy with the newest favoriteModifiedAt. Sources, extension
+// repos and preferences are unioned; for preferences the first backup wins.
+func MergeMihonBackups(backups []*pb.Backup) (*pb.Backup, *MergeReport) {
+	out := &pb.Backup{}
+	report := &MergeReport{Inputs: len(backups), Conflicts: []MergeConflict{}}
+
+	// Merged categories are numbered from 1; ID and order are the same
+	categoryIDs := make(map[string]int64)
+	for _, b := range backups {
+		cats := slices.Clone(b.BackupCategories)
+		sort.SliceStable(cats, func(i, j int) bool { return cats[i].GetOrder() < cats[j].GetOrder() })
+		for _, c := range cats {
+			if _, ok := categoryIDs[c.GetName()]; ok {
+				continue
+			}
+			id := int64(len(out.BackupCategories) + 1)
+			categoryIDs[c.GetName()] = id
+			out.BackupCategories = append(out.BackupCategories, &pb.BackupCategory{
+				Name:  stringPtr(c.GetName()),
+				Order: int64Ptr(id),
+				Id:    int64Ptr(id),
+				Flags: int64Ptr(c.GetFlags()),
+			})
+		}
+	}
+
+	merged := make(map[mangaKey]int) // index in out.BackupManga
+	keptFrom := make(map[mangaKey]int)
+	sources := make(map[int64]bool)
+	repos := make(map[string]bool)
+	prefs := make(map[string]bool)
+	sourcePrefs := make(map[string]int)                // index in out.BackupSourcePreferences
+	sourcePrefKeys := make(map[string]map[string]bool) // source key -> preference keys
+	for i, b := range backups {
+		category := categoryResolver(b)
+		for _, m := range b.BackupManga {
+			m = proto.Clone(m).(*pb.BackupManga)
+			var cats []int64
+			for _, v := range m.Categories {
+				if name, ok := category(v); ok {
+					cats = append(cats, categoryIDs[name])
+				}
+			}
+			m.Categories = cats
+
+			key := mangaKey{m.GetSource(), m.GetUrl()}
+			j, dup := merged[key]
+			if !dup {
+				merged[key] = len(out.BackupManga)
+				keptFrom[key] = i
+				out.BackupManga = append(out.BackupManga, m)
+				continue
+			}
+			prev := out.BackupManga[j]
+			report.Duplicates++
+			if m.GetLastModifiedAt() > prev.GetLastModifiedAt() {
+				if mangaMetadataDiffers(prev, m) {
+					report.Conflicts = append(report.Conflicts, MergeConflict{
+						Title: m.GetTitle(), Url: m.GetUrl(), SourceID: m.GetSource(), Kept: i,
+						Reason: fmt.Sprintf("input %d is newer than input %d", i+1, keptFrom[key]+1),
+					})
+				}
+				keptFrom[key] = i
+				mergeMangaInto(m, prev)
+				out.BackupManga[j] = m
+			} else {
+				if mangaMetadataDiffers(prev, m) {
+					report.Conflicts = append(report.Conflicts, MergeConflict{
+						Title: prev.GetTitle(), Url: prev.GetUrl(), SourceID: prev.GetSource(), Kept: keptFrom[key],
+						Reason: fmt.Sprintf("input %d is not newer than input %d", i+1, keptFrom[key]+1),
+					})
+				}
+				mergeMangaInto(prev, m)
+			}
+		}
+
+		for _, s := range b.BackupSources {
+			if !sources[s.GetSourceId()] {
+				sources[s.GetSourceId()] = true
+				out.BackupSources = append(out.BackupSources, proto.Clone(s).(*pb.BackupSource))
+			}
+		}
+		for _, r := range b.BackupExtensionRepo {
+			if !repos[r.GetBaseUrl()] {
+				repos[r.GetBaseUrl()] = true
+				out.BackupExtensionRepo = append(out.BackupExtensionRepo, proto.Clone(r).(*pb.BackupExtensionRepos))
+			}
+		}
+		for _, p := range b.BackupPreferences {
+			if !prefs[p.GetKey()] {
+				prefs[p.GetKey()] = true
+				out.BackupPreferences = append(out.BackupPreferences, proto.Clone(p).(*pb.BackupPreference))
+			}
+		}
+		for _, sp := range b.BackupSourcePreferences {
+			j, ok := sourcePrefs[sp.GetSourceKey()]
+			if !ok {
+				keys := make(map[string]bool, len(sp.Prefs))
+				for _, p := range sp.Prefs {
+					keys[p.GetKey()] = true
+				}
+				sourcePrefs[sp.GetSourceKey()] = len(out.BackupSourcePreferences)
+				sourcePrefKeys[sp.GetSourceKey()] = keys
+				out.BackupSourcePreferences = append(out.BackupSourcePreferences, proto.Clone(sp).(*pb.BackupSourcePreferences))
+				continue
+			}
+			dst := out.BackupSourcePreferences[j]
+			keys := sourcePrefKeys[sp.GetSourceKey()]
+			for _, p := range sp.Prefs {
+				if !keys[p.GetKey()] {
+					keys[p.GetKey()] = true
+					dst.Prefs = append(dst.Prefs, proto.Clone(p).(*pb.BackupPreference))
+				}
+			}
+		}
+	}
+
+	report.Manga = len(out.BackupManga)
+	report.Categories = len(out.BackupCategories)
+	return out, report
+}
+
+// mangaMetadataDiffers reports whether two copies of a manga disagree on what the user sees
+func mangaMetadataDiffers(a, b *pb.BackupManga) bool {
+	return a.GetTitle() != b.GetTitle() || a.GetAuthor() != b.GetAuthor() ||
+		a.GetArtist() != b.GetArtist() || a.GetDescription() != b.GetDescription() ||
+		a.GetThumbnailUrl() != b.GetThumbnailUrl() || a.GetStatus() != b.GetStatus() ||
+		a.GetNotes() != b.GetNotes() || !slices.Equal(a.Genre, b.Genre)
+}
+
+// mergeMangaInto merges the library state of other into dst, whose metadata is kept
+func mergeMangaInto(dst, other *pb.BackupManga) {
+	if other.GetFavoriteModifiedAt() > dst.GetFavoriteModifiedAt() {
+		dst.Favorite = boolPtr(other.GetFavorite())
+		dst.FavoriteModifiedAt = int64Ptr(other.GetFavoriteModifiedAt())
+	} else if other.GetFavoriteModifiedAt() == dst.GetFavoriteModifiedAt() && other.GetFavorite() {
+		dst.Favorite = boolPtr(true)
+	}
+	if added := other.GetDateAdded(); added > 0 && (dst.GetDateAdded() == 0 || added < dst.GetDateAdded()) {
+		dst.DateAdded = int64Ptr(added)
+	}
+	for _, c := range other.Categories {
+		if !slices.Contains(dst.Categories, c) {
+			dst.Categories = append(dst.Categories, c)
+		}
+	}
+	for _, s := range other.ExcludedScanlators {
+		if !slices.Contains(dst.ExcludedScanlators, s) {
+			dst.ExcludedScanlators = append(dst.ExcludedScanlators, s)
+		}
+	}
+
+	// Chapters: read wins, the newer copy provides the remaining fields
+	chapters := make(map[string]*pb.BackupChapter, len(dst.Chapters))
+	for _, c := range dst.Chapters {
+		chapters[c.GetUrl()] = c
+	}
+	for _, c := range other.Chapters {
+		prev, ok := chapters[c.GetUrl()]
+		if !ok {
+			dst.Chapters = append(dst.Chapters, c)
+			chapters[c.GetUrl()] = c
+			continue
+		}
+		read := prev.GetRead() || c.GetRead()
+		bookmark := prev.GetBookmark() || c.GetBookmark()
+		lastPage := max(prev.GetLastPageRead(), c.GetLastPageRead())
+		if c.GetLastModifiedAt() > prev.GetLastModifiedAt() {
+			proto.Reset(prev)
+			proto.Merge(prev, c)
+		}
+		prev.Read = boolPtr(read)
+		prev.Bookmark = boolPtr(bookmark)
+		prev.LastPageRead = int64Ptr(lastPage)
+	}
+
+	// History: the latest read per chapter wins
+	history := make(map[string]int, len(dst.History))
+	for i, h := range dst.History {
+		history[h.GetUrl()] = i
+	}
+	for _, h := range other.History {
+		idx, ok := history[h.GetUrl()]
+		if !ok {
+			history[h.GetUrl()] = len(dst.History)
+			dst.History = append(dst.History, h)
+			continue
+		}
+		if h.GetLastRead() > dst.History[idx].GetLastRead() {
+			dst.History[idx] = h
+		}
+	}
+
+	// Tracking: one entry per tracker, the one further along wins
+	tracking := make(map[int32]int, len(dst.Tracking))
+	for i, t := range dst.Tracking {
+		tracking[t.GetSyncId()] = i
+	}
+	for _, t := range other.Tracking {
+		idx, ok := tracking[t.GetSyncId()]
+		if !ok {
+			tracking[t.GetSyncId()] = len(dst.Tracking)
+			dst.Tracking = append(dst.Tracking, t)
+			continue
+		}
+		if t.GetLastChapterRead() > dst.Tracking[idx].GetLastChapterRead() {
+			dst.Tracking[idx] = t
+		}
+	}
+
+	dst.LastModifiedAt = int64Ptr(max(dst.GetLastModifiedAt(), other.GetLastModifiedAt()))
+}
+
+// MergeKotatsuBackups combines Kotatsu backups into one library. Manga are
+// deduplicated by (source, url) and categories by title. Kotatsu backups carry
+// no modification times, so the metadata of the first copy of a manga is kept.
+// The latest history entry per manga wins, chapters, bookmarks and favourites
+// are unioned and for each tracker the entry further along wins. Settings and
+// per-source settings are unioned with the first backup winning; the reader
+// grid comes from the first backup that has one.
+func MergeKotatsuBackups(backups []*kotatsu.KotatsuBackup) (*kotatsu.KotatsuBackup, *MergeReport, error) {
+	out := &kotatsu.KotatsuBackup{}
+	report := &MergeReport{Inputs: len(backups), Conflicts: []MergeConflict{}}
+
+	// Merged categories are numbered from 1 in the order they are first seen
+	categoryIDs := make(map[string]int64)
+	for _, kb := range backups {
+		cats := slices.Clone(kb.Categories)
+		sort.SliceStable(cats, func(i, j int) bool { return cats[i].SortKey < cats[j].SortKey })
+		for _, c := range cats {
+			if _, ok := categoryIDs[c.Title]; ok {
+				continue
+			}
+			id := int64(len(out.Categories) + 1)
+			categoryIDs[c.Title] = id
+			out.Categories = append(out.Categories, kotatsu.KotatsuCategory{CategoryId: id, CreatedAt: c.CreatedAt, SortKey: int(id - 1), Title: c.Title})
+		}
+	}
+
+	type kotatsuKey struct{ source, url string }
+	mangaIDs := make(map[kotatsuKey]int64) // merged manga ID per key
+	manga := make(map[int64]kotatsu.KotatsuManga)
+	keptFrom := make(map[int64]int)
+	favourites := make(map[[2]int64]int) // (manga, category) -> index in out.Favourites
+	history := make(map[int64]int)
+	chapters := make(map[int64]map[string]int64) // manga -> chapter URL -> merged chapter ID
+	index := make(map[int64]int)
+	bookmarks := make(map[[3]int64]bool)
+	scrobbling := make(map[[2]int64]int)
+
+	for i, kb := range backups {
+		// manga IDs of this backup -> merged IDs
+		ids := make(map[int64]int64)
+		addManga := func(m kotatsu.KotatsuManga) int64 {
+			if id, ok := ids[m.Id]; ok {
+				return id
+			}
+			key := kotatsuKey{m.Source, m.Url}
+			id, dup := mangaIDs[key]
+			if !dup {
+				id = m.Id
+				if _, taken := manga[id]; taken || id == 0 {
+					id = kotatsu.GenerateUid(m.Source, m.Url)
+				}
+				mangaIDs[key] = id
+				m.Id = id
+				manga[id] = m
+				keptFrom[id] = i
+			} else {
+				report.Duplicates++
+				if prev := manga[id]; kotatsuMangaDiffers(prev, m) {
+					report.Conflicts = append(report.Conflicts, MergeConflict{
+						Title: prev.Title, Url: prev.Url, Source: prev.Source, Kept: keptFrom[id],
+						Reason: fmt.Sprintf("input %d comes before input %d (Kotatsu backups have no modification times)", keptFrom[id]+1, i+1),
+					})
+				}
+			}
+			ids[m.Id] = id
+			return id
+		}
+		for _, f := range kb.Favourites {
+			addManga(f.Manga)
+		}
+		for _, h := range kb.History {
+			if h.Manga != nil {
+				addManga(*h.Manga)
+			}
+		}
+
+		categoryTitles := make(map[int64]string, len(kb.Categories))
+		for _, c := range kb.Categories {
+			categoryTitles[c.CategoryId] = c.Title
+		}
+		for _, f := range kb.Favourites {
+			id := ids[f.Manga.Id]
+			cat := categoryIDs[categoryTitles[f.CategoryId]]
+			if j, dup := favourites[[2]int64{id, cat}]; dup {
+				prev := &out.Favourites[j]
+				prev.Pinned = prev.Pinned || f.Pinned
+				if f.CreatedAt > 0 && (prev.CreatedAt == 0 || f.CreatedAt < prev.CreatedAt) {
+					prev.CreatedAt = f.CreatedAt
+				}
+				continue
+			}
+			f.Manga = manga[id]
+			f.MangaId = id
+			f.CategoryId = cat
+			favourites[[2]int64{id, cat}] = len(out.Favourites)
+			out.Favourites = append(out.Favourites, f)
+		}
+
+		// chapter IDs of this backup -> merged IDs, matched by URL
+		chapterIDs := make(map[int64]int64)
+		for _, e := range kb.Index {
+			id, ok := ids[e.MangaId]
+			if !ok {
+				continue
+			}
+			known := chapters[id]
+			if known == nil {
+				known = make(map[string]int64)
+				chapters[id] = known
+			}
+			j, ok := index[id]
+			if !ok {
+				j = len(out.Index)
+				index[id] = j
+				out.Index = append(out.Index, kotatsu.KotatsuIndexEntry{MangaId: id})
+			}
+			for _, c := range e.Chapters {
+				if merged, ok := known[c.Url]; ok {
+					chapterIDs[c.Id] = merged
+					continue
+				}
+				known[c.Url] = c.Id
+				chapterIDs[c.Id] = c.Id
+				out.Index[j].Chapters = append(out.Index[j].Chapters, c)
+			}
+		}
+		chapterID := func(id int64) int64 {
+			if merged, ok := chapterIDs[id]; ok {
+				return merged
+			}
+			return id
+		}
+
+		for _, h := range kb.History {
+			id, ok := ids[h.MangaId]
+			if !ok {
+				continue
+			}
+			h.MangaId = id
+			h.ChapterId = chapterID(h.ChapterId)
+			m := manga[id]
+			h.Manga = &m
+			if j, dup := history[id]; dup {
+				prev := out.History[j]
+				if prev.CreatedAt > 0 && (h.CreatedAt == 0 || prev.CreatedAt < h.CreatedAt) {
+					h.CreatedAt = prev.CreatedAt
+				}
+				if h.UpdatedAt > prev.UpdatedAt {
+					out.History[j] = h
+				} else {
+					out.History[j].CreatedAt = h.CreatedAt
+				}
+				continue
+			}
+			history[id] = len(out.History)
+			out.History = append(out.History, h)
+		}
+		for _, bm := range kb.Bookmarks {
+			id, ok := ids[bm.MangaId]
+			if !ok {
+				continue
+			}
+			bm.MangaId = id
+			bm.ChapterId = chapterID(bm.ChapterId)
+			key := [3]int64{id, bm.ChapterId, int64(bm.Page)}
+			if bookmarks[key] {
+				continue
+			}
+			bookmarks[key] = true
+			out.Bookmarks = append(out.Bookmarks, bm)
+		}
+		for _, sc := range kb.Scrobbling {
+			id, ok := ids[sc.MangaId]
+			if !ok {
+				continue
+			}
+			sc.MangaId = id
+			key := [2]int64{id, int64(sc.Scrobbler)}
+			if j, dup := scrobbling[key]; dup {
+				if sc.Chapter > out.Scrobbling[j].Chapter {
+					out.Scrobbling[j] = sc
+				}
+				continue
+			}
+			scrobbling[key] = len(out.Scrobbling)
+			out.Scrobbling = append(out.Scrobbling, sc)
+		}
+
+		if out.Info == nil && kb.Info != nil {
+			info := *kb.Info
+			out.Info = &info
+		}
+		if len(out.RawReaderGrid) == 0 {
+			out.RawReaderGrid = kb.RawReaderGrid
+		}
+		var err error
+		if out.RawSettings, err = mergeKotatsuSettings(out.RawSettings, kb.RawSettings); err != nil {
+			return nil, nil, fmt.Errorf("input %d: %w", i+1, err)
+		}
+		if out.RawSources, err = mergeKotatsuSourceSettings(out.RawSources, kb.RawSources); err != nil {
+			return nil, nil, fmt.Errorf("input %d: %w", i+1, err)
+		}
+	}
+
+	report.Manga = len(manga)
+	report.Categories = len(out.Categories)
+	return out, report, nil
+}
+
+// kotatsuMangaDiffers reports whether two copies of a manga disagree on what the user sees
+func kotatsuMangaDiffers(a, b kotatsu.KotatsuManga) bool {
+	return a.Title != b.Title || a.AltTitle != b.AltTitle || a.Author != b.Author ||
+		a.CoverUrl != b.CoverUrl || a.State != b.State || a.Description != b.Description
+}
+
+// mergeKotatsuSettings adds the keys of other missing from the settings section dst
+func mergeKotatsuSettings(dst, other json.RawMessage) (json.RawMessage, error) {
+	if len(other) == 0 {
+		return dst, nil
+	}
+	if len(dst) == 0 {
+		return other, nil
+	}
+	a, err := parseKotatsuRawSettings(dst)
+	if err != nil {
+		return nil, err
+	}
+	b, err := parseKotatsuRawSettings(other)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			a[k] = v
+		}
+	}
+	return json.Marshal([]map[string]json.RawMessage{a})
+}
+
+// parseKotatsuRawSettings is parseKotatsuSettings keeping the values as written
+func parseKotatsuRawSettings(raw json.RawMessage) (map[string]json.RawMessage, error) {
+	settings := make(map[string]json.RawMessage)
+	var arr []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &arr); err == nil {
+		for _, obj := range arr {
+			for k, v := range obj {
+				settings[k] = v
+			}
+		}
+		return settings, nil
+	}
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		return nil, fmt.Errorf("decode settings: %w", err)
+	}
+	return settings, nil
+}
+
+// mergeKotatsuSourceSettings adds the parsers of other missing from the "sources" section dst
+func mergeKotatsuSourceSettings(dst, other json.RawMessage) (json.RawMessage, error) {
+	if len(other) == 0 {
+		return dst, nil
+	}
+	if len(dst) == 0 {
+		return other, nil
+	}
+	var a, b []map[string]json.RawMessage
+	if err := json.Unmarshal(dst, &a); err != nil {
+		return nil, fmt.Errorf("decode sources: %w", err)
+	}
+	if err := json.Unmarshal(other, &b); err != nil {
+		return nil, fmt.Errorf("decode sources: %w", err)
+	}
+	known := make(map[string]bool, len(a))
+	for _, s := range a {
+		known[string(s["source"])] = true
+	}
+	for _, s := range b {
+		if !known[string(s["source"])] {
+			known[string(s["source"])] = true
+			a = append(a, s)
+		}
+	}
+	return json.Marshal(a)
+}
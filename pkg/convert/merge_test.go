@@ -0,0 +1,177 @@
+package convert
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/galpt/mk-bkconv/pkg/kotatsu"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMergeMihonBackups(t *testing.T) {
+	older := testMihonManga(1, "/a",
+		testMihonChapter("/a/2", 0, false, 3),
+		testMihonChapter("/a/1", 1, true, 0),
+	)
+	older.Title = stringPtr("Old title")
+	older.LastModifiedAt = int64Ptr(100)
+	older.Categories = []int64{5} // "Reading" in the first backup
+	older.History = []*pb.BackupHistory{{Url: stringPtr("/a/1"), LastRead: int64Ptr(300)}}
+	older.Tracking = []*pb.BackupTracking{{SyncId: int32Ptr(2), LibraryId: int64Ptr(1), LastChapterRead: float32Ptr(1)}}
+
+	newer := testMihonManga(1, "/a",
+		testMihonChapter("/a/2", 0, true, 0),
+		testMihonChapter("/a/1", 1, false, 0),
+	)
+	newer.Title = stringPtr("New title")
+	newer.LastModifiedAt = int64Ptr(200)
+	newer.Categories = []int64{0} // "Done" in the second backup
+	newer.History = []*pb.BackupHistory{{Url: stringPtr("/a/1"), LastRead: int64Ptr(100)}, {Url: stringPtr("/a/2"), LastRead: int64Ptr(400)}}
+	newer.Tracking = []*pb.BackupTracking{{SyncId: int32Ptr(2), LibraryId: int64Ptr(1), LastChapterRead: float32Ptr(2)}}
+
+	pref := func(key, value string) *pb.BackupPreference {
+		return &pb.BackupPreference{Key: stringPtr(key), Value: &pb.PreferenceValue{Type: stringPtr("string"), Truevalue: []byte(value)}}
+	}
+	a := &pb.Backup{
+		BackupManga:             []*pb.BackupManga{older, testMihonManga(1, "/b")},
+		BackupCategories:        []*pb.BackupCategory{{Name: stringPtr("Reading"), Order: int64Ptr(5)}},
+		BackupSources:           []*pb.BackupSource{{SourceId: int64Ptr(1), Name: stringPtr("One")}},
+		BackupPreferences:       []*pb.BackupPreference{pref("theme", "dark")},
+		BackupSourcePreferences: []*pb.BackupSourcePreferences{{SourceKey: stringPtr("source_1"), Prefs: []*pb.BackupPreference{pref("lang", "en")}}},
+	}
+	b := &pb.Backup{
+		BackupManga:             []*pb.BackupManga{newer, testMihonManga(2, "/a")},
+		BackupCategories:        []*pb.BackupCategory{{Name: stringPtr("Done"), Order: int64Ptr(0)}, {Name: stringPtr("Reading"), Order: int64Ptr(1)}},
+		BackupSources:           []*pb.BackupSource{{SourceId: int64Ptr(1), Name: stringPtr("One")}, {SourceId: int64Ptr(2), Name: stringPtr("Two")}},
+		BackupPreferences:       []*pb.BackupPreference{pref("theme", "light"), pref("columns", "3")},
+		BackupSourcePreferences: []*pb.BackupSourcePreferences{{SourceKey: stringPtr("source_1"), Prefs: []*pb.BackupPreference{pref("lang", "fr"), pref("quality", "high")}}},
+	}
+
+	out, report := MergeMihonBackups([]*pb.Backup{a, b})
+	if report.Inputs != 2 || report.Manga != 3 || report.Duplicates != 1 || report.Categories != 2 {
+		t.Errorf("report = %+v, want 2 inputs, 3 manga, 1 duplicate, 2 categories", report)
+	}
+	if len(report.Conflicts) != 1 || report.Conflicts[0].Kept != 1 {
+		t.Errorf("conflicts = %+v, want the title conflict resolved to input 1", report.Conflicts)
+	}
+
+	var names []string
+	for _, c := range out.BackupCategories {
+		names = append(names, c.GetName())
+	}
+	if want := []string{"Reading", "Done"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("categories = %v, want %v", names, want)
+	}
+
+	if len(out.BackupManga) != 3 || out.BackupManga[0].GetUrl() != "/a" || out.BackupManga[0].GetSource() != 1 {
+		t.Fatalf("manga = %v, want the merged /a first", out.BackupManga)
+	}
+	m := out.BackupManga[0]
+	if m.GetTitle() != "New title" || m.GetLastModifiedAt() != 200 {
+		t.Errorf("metadata = %q at %d, want the newer copy", m.GetTitle(), m.GetLastModifiedAt())
+	}
+	if want := []int64{2, 1}; !reflect.DeepEqual(m.Categories, want) {
+		t.Errorf("categories = %v, want %v", m.Categories, want)
+	}
+	for _, c := range m.Chapters {
+		if !c.GetRead() {
+			t.Errorf("chapter %s is unread, want read in any copy to win", c.GetUrl())
+		}
+		if c.GetUrl() == "/a/2" && c.GetLastPageRead() != 3 {
+			t.Errorf("chapter /a/2 last page = %d, want 3", c.GetLastPageRead())
+		}
+	}
+	lastRead := make(map[string]int64)
+	for _, h := range m.History {
+		lastRead[h.GetUrl()] = h.GetLastRead()
+	}
+	if want := map[string]int64{"/a/1": 300, "/a/2": 400}; !reflect.DeepEqual(lastRead, want) {
+		t.Errorf("history = %v, want %v", lastRead, want)
+	}
+	if len(m.Tracking) != 1 || m.Tracking[0].GetLastChapterRead() != 2 {
+		t.Errorf("tracking = %v, want the entry further along", m.Tracking)
+	}
+
+	if len(out.BackupSources) != 2 {
+		t.Errorf("sources = %v, want 2", out.BackupSources)
+	}
+	if len(out.BackupPreferences) != 2 || string(out.BackupPreferences[0].Value.Truevalue) != "dark" {
+		t.Errorf("preferences = %v, want the first backup's theme and the added columns", out.BackupPreferences)
+	}
+	sp := out.BackupSourcePreferences
+	if len(sp) != 1 || len(sp[0].Prefs) != 2 || string(sp[0].Prefs[0].Value.Truevalue) != "en" {
+		t.Errorf("source preferences = %v, want lang from the first backup and quality added", sp)
+	}
+	// the inputs are not modified
+	if a.BackupManga[0].GetTitle() != "Old title" || len(a.BackupManga[0].History) != 1 {
+		t.Error("merging modified the first input")
+	}
+}
+
+func TestMergeMihonBackupWithItself(t *testing.T) {
+	m := testMihonManga(1, "/a", testMihonChapter("/a/1", 0, true, 2))
+	m.Categories = []int64{1}
+	m.History = []*pb.BackupHistory{{Url: stringPtr("/a/1"), LastRead: int64Ptr(100)}}
+	// fields the merge always sets
+	m.LastModifiedAt = int64Ptr(0)
+	m.Chapters[0].Bookmark = boolPtr(false)
+	b := &pb.Backup{
+		BackupManga:      []*pb.BackupManga{m},
+		BackupCategories: []*pb.BackupCategory{{Name: stringPtr("Reading"), Order: int64Ptr(1), Id: int64Ptr(1), Flags: int64Ptr(0)}},
+		BackupSources:    []*pb.BackupSource{{SourceId: int64Ptr(1), Name: stringPtr("One")}},
+	}
+	out, report := MergeMihonBackups([]*pb.Backup{b, b})
+	if report.Duplicates != 1 || len(report.Conflicts) != 0 {
+		t.Errorf("report = %+v, want 1 duplicate and no conflicts", report)
+	}
+	if !proto.Equal(out, b) {
+		t.Errorf("merging a backup with itself changed it:\ngot  %v\nwant %v", out, b)
+	}
+}
+
+func TestMergeKotatsuBackups(t *testing.T) {
+	a := testKotatsuBackup("MANGADEX", "/a", "/b")
+	b := testKotatsuBackup("MANGADEX", "/a", "/c")
+	b.Categories[0].Title = "Done"
+	// the second copy of /a was read further and has a chapter the first lacks
+	b.History[0].UpdatedAt = 10
+	b.History[0].Page = 9
+	extra := kotatsu.KotatsuChapter{Id: kotatsu.GenerateUid("MANGADEX", "/a/2"), Name: "Chapter 2", Url: "/a/2"}
+	b.Index[0].Chapters = append(b.Index[0].Chapters, extra)
+	b.Scrobbling[0].Chapter = 3
+
+	out, report, err := MergeKotatsuBackups([]*kotatsu.KotatsuBackup{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Manga != 3 || report.Duplicates != 1 || report.Categories != 2 {
+		t.Errorf("report = %+v, want 3 manga, 1 duplicate, 2 categories", report)
+	}
+	// /a is a favourite in both categories
+	if len(out.Favourites) != 4 {
+		t.Errorf("got %d favourites, want 4", len(out.Favourites))
+	}
+	id := kotatsu.GenerateUid("MANGADEX", "/a")
+	for _, e := range out.Index {
+		if e.MangaId == id && len(e.Chapters) != 2 {
+			t.Errorf("/a has %d chapters, want 2", len(e.Chapters))
+		}
+	}
+	for _, h := range out.History {
+		if h.MangaId == id && h.Page != 9 {
+			t.Errorf("/a history page = %d, want the newer entry's 9", h.Page)
+		}
+	}
+	if len(out.Bookmarks) != 3 {
+		t.Errorf("got %d bookmarks, want 3", len(out.Bookmarks))
+	}
+	for _, sc := range out.Scrobbling {
+		if sc.MangaId == id && sc.Chapter != 3 {
+			t.Errorf("/a scrobbling chapter = %d, want 3", sc.Chapter)
+		}
+	}
+	if len(out.Scrobbling) != 3 {
+		t.Errorf("got %d scrobbling entries, want 3", len(out.Scrobbling))
+	}
+}
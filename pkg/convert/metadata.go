@@ -0,0 +1,194 @@
+package convert
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/galpt/mk-bkconv/pkg/kotatsu"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+)
+
+// Mihon manga status values (SManga constants)
+const (
+	mihonStatusUnknown            int32 = 0
+	mihonStatusOngoing            int32 = 1
+	mihonStatusCompleted          int32 = 2
+	mihonStatusLicensed           int32 = 3
+	mihonStatusPublishingFinished int32 = 4
+	mihonStatusCancelled          int32 = 5
+	mihonStatusOnHiatus           int32 = 6
+)
+
+// Kotatsu MangaState and ContentRating enum names
+const (
+	kotatsuStateOngoing    = "ONGOING"
+	kotatsuStateFinished   = "FINISHED"
+	kotatsuStateAbandoned  = "ABANDONED"
+	kotatsuStatePaused     = "PAUSED"
+	kotatsuStateUpcoming   = "UPCOMING"
+	kotatsuStateRestricted = "RESTRICTED"
+
+	kotatsuContentSafe       = "SAFE"
+	kotatsuContentSuggestive = "SUGGESTIVE"
+	kotatsuContentAdult      = "ADULT"
+)
+
+// kotatsuRatingUnknown is what Kotatsu uses when a source does not provide a rating
+const kotatsuRatingUnknown float32 = -1
+
+// altTitlePrefix marks the alternative title line that is added to Mihon descriptions,
+// Mihon has no dedicated field for it
+const altTitlePrefix = "Alternative title: "
+
+// nsfwGenre is added to Mihon genres for manga Kotatsu flags as adult content
+const nsfwGenre = "NSFW"
+
+// Genres that imply a content rating when converting Mihon genres to Kotatsu
+var (
+	adultGenres      = []string{"adult", "hentai", "nsfw", "smut", "pornographic", "erotica"}
+	suggestiveGenres = []string{"ecchi", "mature", "suggestive"}
+)
+
+// applyKotatsuMetadata copies the descriptive fields of a Kotatsu manga onto a Mihon manga
+func applyKotatsuMetadata(m *pb.BackupManga, km kotatsu.KotatsuManga) {
+	genres := kotatsuTagsToGenres(km.Tags)
+	if (km.Nsfw || km.ContentRating == kotatsuContentAdult) && contentRatingFromGenres(genres) != kotatsuContentAdult {
+		genres = append(genres, nsfwGenre)
+	}
+	m.Genre = genres
+	m.Status = int32Ptr(kotatsuStateToMihonStatus(km.State))
+	m.Description = stringPtr(joinAltTitle(km.Description, km.AltTitle))
+}
+
+// applyMihonMetadata copies the descriptive fields of a Mihon manga onto a Kotatsu manga
+func applyMihonMetadata(km *kotatsu.KotatsuManga, m *pb.BackupManga) {
+	description, altTitle := splitAltTitle(m.GetDescription())
+	km.Description = description
+	km.AltTitle = altTitle
+	// Kotatsu only has a single author field
+	if km.Author == "" {
+		km.Author = m.GetArtist()
+	}
+	km.State = mihonStatusToKotatsuState(m.GetStatus())
+	km.Rating = kotatsuRatingUnknown
+
+	genres := slices.DeleteFunc(slices.Clone(m.GetGenre()), func(g string) bool {
+		return g == nsfwGenre
+	})
+	km.ContentRating = contentRatingFromGenres(m.GetGenre())
+	km.Nsfw = km.ContentRating == kotatsuContentAdult
+	km.Tags = genresToKotatsuTags(genres, km.Source)
+}
+
+// kotatsuTagsToGenres extracts tag titles from Kotatsu tag objects ({"title", "key", "source"}).
+// Plain strings are accepted as well.
+func kotatsuTagsToGenres(tags []interface{}) []string {
+	genres := []string{}
+	for _, t := range tags {
+		switch v := t.(type) {
+		case string:
+			if v != "" {
+				genres = append(genres, v)
+			}
+		case map[string]interface{}:
+			if title, ok := v["title"].(string); ok && title != "" {
+				genres = append(genres, title)
+			} else if key, ok := v["key"].(string); ok && key != "" {
+				genres = append(genres, key)
+			}
+		}
+	}
+	return genres
+}
+
+// genresToKotatsuTags builds Kotatsu tag objects from Mihon genre strings
+func genresToKotatsuTags(genres []string, source string) []interface{} {
+	tags := []interface{}{}
+	for _, g := range genres {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+		tags = append(tags, map[string]interface{}{
+			"title":  g,
+			"key":    strings.ToLower(g),
+			"source": source,
+		})
+	}
+	return tags
+}
+
+// kotatsuStateToMihonStatus maps Kotatsu's MangaState enum to Mihon's status int
+func kotatsuStateToMihonStatus(state string) int32 {
+	switch strings.ToUpper(state) {
+	case kotatsuStateOngoing, kotatsuStateUpcoming:
+		return mihonStatusOngoing
+	case kotatsuStateFinished:
+		return mihonStatusCompleted
+	case kotatsuStateAbandoned:
+		return mihonStatusCancelled
+	case kotatsuStatePaused:
+		return mihonStatusOnHiatus
+	case kotatsuStateRestricted:
+		return mihonStatusLicensed
+	default:
+		return mihonStatusUnknown
+	}
+}
+
+// mihonStatusToKotatsuState maps Mihon's status int to Kotatsu's MangaState enum
+func mihonStatusToKotatsuState(status int32) string {
+	switch status {
+	case mihonStatusOngoing:
+		return kotatsuStateOngoing
+	case mihonStatusCompleted, mihonStatusPublishingFinished:
+		return kotatsuStateFinished
+	case mihonStatusLicensed:
+		return kotatsuStateRestricted
+	case mihonStatusCancelled:
+		return kotatsuStateAbandoned
+	case mihonStatusOnHiatus:
+		return kotatsuStatePaused
+	default:
+		return ""
+	}
+}
+
+// contentRatingFromGenres guesses Kotatsu's content rating from genre names
+func contentRatingFromGenres(genres []string) string {
+	rating := kotatsuContentSafe
+	for _, g := range genres {
+		g = strings.ToLower(strings.TrimSpace(g))
+		if slices.Contains(adultGenres, g) {
+			return kotatsuContentAdult
+		}
+		if slices.Contains(suggestiveGenres, g) {
+			rating = kotatsuContentSuggestive
+		}
+	}
+	return rating
+}
+
+// joinAltTitle appends the alternative title to a description
+func joinAltTitle(description, altTitle string) string {
+	if altTitle == "" {
+		return description
+	}
+	if description == "" {
+		return altTitlePrefix + altTitle
+	}
+	return description + "\n\n" + altTitlePrefix + altTitle
+}
+
+// splitAltTitle is the inverse of joinAltTitle
+func splitAltTitle(description string) (string, string) {
+	i := strings.LastIndex(description, altTitlePrefix)
+	if i < 0 || (i > 0 && description[i-1] != '\n') {
+		return description, ""
+	}
+	altTitle := strings.TrimSpace(description[i+len(altTitlePrefix):])
+	if strings.Contains(altTitle, "\n") {
+		return description, ""
+	}
+	return strings.TrimSpace(description[:i]), altTitle
+}
@@ -0,0 +1,408 @@
+package convert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/galpt/mk-bkconv/pkg/kotatsu"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+)
+
+// MihonTarget is the source manga are migrated to
+type MihonTarget struct {
+	Name      string
+	Lang      string
+	VersionID int
+}
+
+// ParseMihonTarget parses "name/lang/version"; the name itself may contain slashes
+func ParseMihonTarget(s string) (MihonTarget, error) {
+	rest, version, ok := cutLast(s, "/")
+	if !ok {
+		return MihonTarget{}, fmt.Errorf("invalid target %q (expected name/lang/version)", s)
+	}
+	name, lang, ok := cutLast(rest, "/")
+	if !ok || name == "" || lang == "" {
+		return MihonTarget{}, fmt.Errorf("invalid target %q (expected name/lang/version)", s)
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil || v < 1 {
+		return MihonTarget{}, fmt.Errorf("invalid version %q in target %q", version, s)
+	}
+	return MihonTarget{Name: name, Lang: lang, VersionID: v}, nil
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// SourceID returns the Mihon source ID of the target, preferring the ID published
+// in KeiyoushiIndex over GenerateMihonSourceID
+func (t MihonTarget) SourceID() int64 {
+	id, _ := SourceMapping{MihonName: t.Name, MihonLang: t.Lang, MihonVersionID: t.VersionID}.SourceID()
+	return id
+}
+
+// URLRewrite rewrites manga and chapter URLs with a regular expression;
+// Replacement may refer to capture groups as $1
+type URLRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// rewrite applies the rewrite to url, counting it in unmatched when the pattern does not match
+func (r *URLRewrite) rewrite(url string, unmatched *int) string {
+	if !r.Pattern.MatchString(url) {
+		*unmatched++
+		return url
+	}
+	return r.Pattern.ReplaceAllString(url, r.Replacement)
+}
+
+// MihonMigration moves the manga of one source in a Mihon backup to another source
+type MihonMigration struct {
+	// From is a source ID or a source name as listed in BackupSources
+	From string
+	To   MihonTarget
+	// URLs optionally rewrites manga, chapter and history URLs; manga whose URL
+	// does not match are not migrated
+	URLs *URLRewrite
+}
+
+// MigrationReport describes what a migration did
+type MigrationReport struct {
+	FromID   int64  `json:"from_id"`
+	FromName string `json:"from_name,omitempty"`
+	ToID     int64  `json:"to_id"`
+	ToName   string `json:"to_name"`
+	Migrated int    `json:"migrated"`
+	// NotMigrated lists manga of the source that were left on it
+	NotMigrated []DroppedManga `json:"not_migrated"`
+	// UnmatchedURLs counts chapter and history URLs of migrated manga that did
+	// not match the rewrite pattern and were kept as they were
+	UnmatchedURLs int `json:"unmatched_urls"`
+}
+
+// resolveFrom returns the source selected by a source ID or name
+func resolveFrom(b *pb.Backup, from string) (int64, string, error) {
+	if id, err := strconv.ParseInt(from, 10, 64); err == nil {
+		name := ""
+		for _, s := range b.BackupSources {
+			if s.GetSourceId() == id {
+				name = s.GetName()
+			}
+		}
+		return id, name, nil
+	}
+	var ids []int64
+	name := ""
+	for _, s := range b.BackupSources {
+		if strings.EqualFold(s.GetName(), from) {
+			ids = append(ids, s.GetSourceId())
+			name = s.GetName()
+		}
+	}
+	switch {
+	case len(ids) == 0:
+		return 0, "", fmt.Errorf("no source named %q in the backup", from)
+	case len(ids) > 1:
+		return 0, "", fmt.Errorf("source name %q is ambiguous (IDs %v), use the source ID", from, ids)
+	}
+	return ids[0], name, nil
+}
+
+// MigrateMihonSource rewrites BackupManga.Source (and optionally URLs) of every
+// manga on the From source to the target source and updates BackupSources.
+// A manga stays on its source when its URL does not match the rewrite or when
+// the target source already has a manga with the same URL.
+func MigrateMihonSource(b *pb.Backup, mig MihonMigration) (*MigrationReport, error) {
+	if mig.From == "" {
+		return nil, errors.New("no source to migrate from")
+	}
+	fromID, fromName, err := resolveFrom(b, mig.From)
+	if err != nil {
+		return nil, err
+	}
+	toID := mig.To.SourceID()
+	report := &MigrationReport{
+		FromID:      fromID,
+		FromName:    fromName,
+		ToID:        toID,
+		ToName:      mig.To.Name,
+		NotMigrated: []DroppedManga{},
+	}
+	if fromID == toID {
+		return nil, fmt.Errorf("source %d is already the target", toID)
+	}
+
+	existing := make(map[string]struct{})
+	for _, m := range b.BackupManga {
+		if m.GetSource() == toID {
+			existing[m.GetUrl()] = struct{}{}
+		}
+	}
+
+	remaining := 0
+	for _, m := range b.BackupManga {
+		if m.GetSource() != fromID {
+			continue
+		}
+		url := m.GetUrl()
+		if mig.URLs != nil {
+			if !mig.URLs.Pattern.MatchString(url) {
+				report.NotMigrated = append(report.NotMigrated, droppedManga(m, fromName, "URL does not match the rewrite pattern"))
+				remaining++
+				continue
+			}
+			url = mig.URLs.Pattern.ReplaceAllString(url, mig.URLs.Replacement)
+		}
+		if _, dup := existing[url]; dup {
+			report.NotMigrated = append(report.NotMigrated, droppedManga(m, fromName, "the target source already has a manga with this URL"))
+			remaining++
+			continue
+		}
+		existing[url] = struct{}{}
+
+		m.Source = int64Ptr(toID)
+		if mig.URLs != nil {
+			m.Url = stringPtr(url)
+			for _, c := range m.Chapters {
+				c.Url = stringPtr(mig.URLs.rewrite(c.GetUrl(), &report.UnmatchedURLs))
+			}
+			for _, h := range m.History {
+				h.Url = stringPtr(mig.URLs.rewrite(h.GetUrl(), &report.UnmatchedURLs))
+			}
+		}
+		report.Migrated++
+	}
+
+	if report.Migrated == 0 && remaining == 0 {
+		return nil, fmt.Errorf("no manga on source %s in the backup", mig.From)
+	}
+
+	// Drop source entries nothing points to anymore and list the target once
+	var sources []*pb.BackupSource
+	hasTarget := false
+	for _, s := range b.BackupSources {
+		id := s.GetSourceId()
+		if id == fromID && remaining == 0 {
+			continue
+		}
+		if id == toID {
+			hasTarget = true
+		}
+		sources = append(sources, s)
+	}
+	if !hasTarget && report.Migrated > 0 {
+		sources = append(sources, &pb.BackupSource{Name: stringPtr(mig.To.Name), SourceId: int64Ptr(toID)})
+	}
+	b.BackupSources = sources
+	return report, nil
+}
+
+// KotatsuMigration renames a parser in a Kotatsu backup, e.g. NIGHTSCANS to QISCANS
+type KotatsuMigration struct {
+	From string
+	To   string
+}
+
+// KotatsuMigrationReport describes what a Kotatsu migration did
+type KotatsuMigrationReport struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Migrated int    `json:"migrated"`
+	// NotMigrated lists manga of the source that were left on it
+	NotMigrated []DroppedManga `json:"not_migrated"`
+	// UnknownChapters counts history rows and bookmarks whose chapter is not in
+	// the index; their chapter ID cannot be recomputed and is kept
+	UnknownChapters int `json:"unknown_chapters"`
+	// Warnings names each history row and bookmark counted in UnknownChapters
+	Warnings []string `json:"warnings"`
+}
+
+// MigrateKotatsuSource moves every manga of the From parser to the To parser.
+// Manga and chapter IDs derive from the parser name, so they are recomputed with
+// kotatsu.GenerateUid and replaced in favourites, history, bookmarks, index and
+// scrobbling; bookmark page IDs are recomputed from the chapter URL like
+// MihonToKotatsu does. Chapter URLs are only known from the index, so history
+// rows and bookmarks of chapters missing from it keep their IDs and are listed
+// in the report's warnings. A manga stays on its source when the target parser already has a
+// manga with the same URL.
+func MigrateKotatsuSource(kb *kotatsu.KotatsuBackup, mig KotatsuMigration) (*KotatsuMigrationReport, error) {
+	if mig.From == "" || mig.To == "" {
+		return nil, errors.New("both the source and the target parser are required")
+	}
+	if mig.From == mig.To {
+		return nil, fmt.Errorf("source %s is already the target", mig.To)
+	}
+	report := &KotatsuMigrationReport{From: mig.From, To: mig.To, NotMigrated: []DroppedManga{}, Warnings: []string{}}
+
+	// Collect the manga of both parsers; history rows may hold manga that are not favourites
+	var manga []*kotatsu.KotatsuManga
+	for i := range kb.Favourites {
+		manga = append(manga, &kb.Favourites[i].Manga)
+	}
+	for i := range kb.History {
+		if kb.History[i].Manga != nil {
+			manga = append(manga, kb.History[i].Manga)
+		}
+	}
+	existing := make(map[int64]struct{})
+	for _, m := range manga {
+		if m.Source == mig.To {
+			existing[m.Id] = struct{}{}
+		}
+	}
+
+	// Old manga ID -> new manga ID
+	mangaIDs := make(map[int64]int64)
+	titles := make(map[int64]string) // old manga ID -> title, for warnings
+	skipped := make(map[int64]struct{})
+	for _, m := range manga {
+		if m.Source != mig.From {
+			continue
+		}
+		if _, done := mangaIDs[m.Id]; done {
+			continue
+		}
+		if _, done := skipped[m.Id]; done {
+			continue
+		}
+		newID := kotatsu.GenerateUid(mig.To, m.Url)
+		if _, dup := existing[newID]; dup {
+			skipped[m.Id] = struct{}{}
+			report.NotMigrated = append(report.NotMigrated, DroppedManga{
+				Title:  m.Title,
+				Url:    m.Url,
+				Source: mig.From,
+				Reason: "the target parser already has a manga with this URL",
+			})
+			continue
+		}
+		mangaIDs[m.Id] = newID
+		titles[m.Id] = m.Title
+		report.Migrated++
+	}
+	if report.Migrated == 0 && len(skipped) == 0 {
+		return nil, fmt.Errorf("no manga on source %s in the backup", mig.From)
+	}
+
+	for _, m := range manga {
+		if newID, ok := mangaIDs[m.Id]; ok && m.Source == mig.From {
+			m.Id = newID
+			m.Source = mig.To
+			for _, tag := range m.Tags {
+				if t, ok := tag.(map[string]interface{}); ok && t["source"] == mig.From {
+					t["source"] = mig.To
+				}
+			}
+		}
+	}
+
+	// Old chapter ID -> chapter URL, per old manga ID
+	chapterURLs := make(map[int64]map[int64]string)
+	for i := range kb.Index {
+		e := &kb.Index[i]
+		newID, ok := mangaIDs[e.MangaId]
+		if !ok {
+			continue
+		}
+		urls := make(map[int64]string, len(e.Chapters))
+		for j := range e.Chapters {
+			c := &e.Chapters[j]
+			urls[c.Id] = c.Url
+			c.Id = kotatsu.GenerateUid(mig.To, c.Url)
+		}
+		chapterURLs[e.MangaId] = urls
+		e.MangaId = newID
+	}
+	// chapterURL looks up a chapter of a migrated manga, warning about the
+	// reference (what) when it cannot be found
+	chapterURL := func(mangaID, id int64, what string) (string, bool) {
+		if url, ok := chapterURLs[mangaID][id]; ok {
+			return url, true
+		}
+		report.UnknownChapters++
+		reason := "the chapter is not in the chapter index"
+		if len(chapterURLs[mangaID]) == 0 {
+			reason = "the manga has no chapter index"
+		}
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %s of chapter %d keeps its old ID, %s", titles[mangaID], what, id, reason))
+		return "", false
+	}
+
+	for i := range kb.Favourites {
+		if newID, ok := mangaIDs[kb.Favourites[i].MangaId]; ok {
+			kb.Favourites[i].MangaId = newID
+		}
+	}
+	for i := range kb.History {
+		h := &kb.History[i]
+		if newID, ok := mangaIDs[h.MangaId]; ok {
+			if url, ok := chapterURL(h.MangaId, h.ChapterId, "history"); ok {
+				h.ChapterId = kotatsu.GenerateUid(mig.To, url)
+			}
+			h.MangaId = newID
+		}
+	}
+	for i := range kb.Bookmarks {
+		bm := &kb.Bookmarks[i]
+		if newID, ok := mangaIDs[bm.MangaId]; ok {
+			if url, ok := chapterURL(bm.MangaId, bm.ChapterId, fmt.Sprintf("bookmark on page %d", bm.Page)); ok {
+				bm.ChapterId = kotatsu.GenerateUid(mig.To, url)
+				bm.PageId = kotatsu.GenerateUid(mig.To, fmt.Sprintf("%s#%d", url, bm.Page))
+			}
+			bm.MangaId = newID
+		}
+	}
+	for i := range kb.Scrobbling {
+		if newID, ok := mangaIDs[kb.Scrobbling[i].MangaId]; ok {
+			kb.Scrobbling[i].MangaId = newID
+		}
+	}
+
+	if len(skipped) == 0 {
+		raw, err := renameKotatsuSourceSettings(kb.RawSources, mig.From, mig.To)
+		if err != nil {
+			return nil, err
+		}
+		kb.RawSources = raw
+	}
+	return report, nil
+}
+
+// renameKotatsuSourceSettings renames the parser in the "sources" section, which
+// holds one {"source": NAME, ...} object per parser, unless the target already has one
+func renameKotatsuSourceSettings(raw json.RawMessage, from, to string) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return raw, nil
+	}
+	var sources []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &sources); err != nil {
+		return nil, fmt.Errorf("decode sources: %w", err)
+	}
+	fromName, _ := json.Marshal(from)
+	toName, _ := json.Marshal(to)
+	index := -1
+	for i, s := range sources {
+		switch string(s["source"]) {
+		case string(toName):
+			return raw, nil
+		case string(fromName):
+			index = i
+		}
+	}
+	if index < 0 {
+		return raw, nil
+	}
+	sources[index]["source"] = toName
+	return json.Marshal(sources)
+}
@@ -0,0 +1,190 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/galpt/mk-bkconv/pkg/kotatsu"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMigrateMihonSourceRoundTrip(t *testing.T) {
+	from := MihonTarget{Name: "Night Scans", Lang: "en", VersionID: 1}
+	to := MihonTarget{Name: "Qi Scans", Lang: "en", VersionID: 1}
+	fromID, toID := from.SourceID(), to.SourceID()
+
+	withHistory := func(m *pb.BackupManga) *pb.BackupManga {
+		m.History = []*pb.BackupHistory{{Url: stringPtr(m.Chapters[0].GetUrl()), LastRead: int64Ptr(1000)}}
+		return m
+	}
+	b := &pb.Backup{
+		BackupManga: []*pb.BackupManga{
+			withHistory(testMihonManga(fromID, "/series/one/", testMihonChapter("/one-chapter-1/", 0, true, 0))),
+			testMihonManga(fromID, "/other/two/"),
+			testMihonManga(toID, "/manga/three/"),
+			testMihonManga(fromID, "/series/three/"),
+		},
+		BackupSources: []*pb.BackupSource{
+			{SourceId: int64Ptr(fromID), Name: stringPtr(from.Name)},
+			{SourceId: int64Ptr(toID), Name: stringPtr(to.Name)},
+		},
+	}
+	original := proto.Clone(b).(*pb.Backup)
+
+	report, err := MigrateMihonSource(b, MihonMigration{
+		From: from.Name,
+		To:   to,
+		URLs: &URLRewrite{Pattern: regexp.MustCompile(`^/series/`), Replacement: "/manga/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 1 || len(report.NotMigrated) != 2 {
+		t.Fatalf("migrated %d, left %v; want 1 migrated and 2 left", report.Migrated, report.NotMigrated)
+	}
+	// chapter URLs lack the manga prefix and are kept
+	if report.UnmatchedURLs != 2 {
+		t.Errorf("unmatched URLs = %d, want 2", report.UnmatchedURLs)
+	}
+	if m := b.BackupManga[0]; m.GetSource() != toID || m.GetUrl() != "/manga/one/" {
+		t.Errorf("migrated manga = %d %q, want %d /manga/one/", m.GetSource(), m.GetUrl(), toID)
+	}
+	for _, i := range []int{1, 3} {
+		if got := b.BackupManga[i].GetSource(); got != fromID {
+			t.Errorf("manga %s moved to %d, want it left on %d", b.BackupManga[i].GetUrl(), got, fromID)
+		}
+	}
+	if len(b.BackupSources) != 2 {
+		t.Errorf("sources = %v, want both kept", b.BackupSources)
+	}
+
+	report, err = MigrateMihonSource(b, MihonMigration{
+		From: fmt.Sprint(toID),
+		To:   from,
+		URLs: &URLRewrite{Pattern: regexp.MustCompile(`^/manga/one/$`), Replacement: "/series/one/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 1 {
+		t.Fatalf("migrated %d manga back, want 1", report.Migrated)
+	}
+	if !proto.Equal(b, original) {
+		t.Errorf("migrating back changed the backup:\ngot  %v\nwant %v", b, original)
+	}
+}
+
+func TestMigrateMihonSourceErrors(t *testing.T) {
+	target := MihonTarget{Name: "Qi Scans", Lang: "en", VersionID: 1}
+	b := &pb.Backup{
+		BackupManga: []*pb.BackupManga{testMihonManga(1, "/a")},
+		BackupSources: []*pb.BackupSource{
+			{SourceId: int64Ptr(1), Name: stringPtr("Same")},
+			{SourceId: int64Ptr(2), Name: stringPtr("Same")},
+		},
+	}
+	for _, from := range []string{"", "Same", "Missing", "3"} {
+		if _, err := MigrateMihonSource(b, MihonMigration{From: from, To: target}); err == nil {
+			t.Errorf("migrating from %q succeeded", from)
+		}
+	}
+}
+
+// testKotatsuBackup returns a backup whose manga IDs, chapter IDs and bookmark
+// page IDs are derived from source like MihonToKotatsu derives them
+func testKotatsuBackup(source string, urls ...string) *kotatsu.KotatsuBackup {
+	kb := &kotatsu.KotatsuBackup{
+		Categories: []kotatsu.KotatsuCategory{{CategoryId: 1, Title: "Reading"}},
+		RawSources: json.RawMessage(fmt.Sprintf(`[{"enabled":true,"source":%q}]`, source)),
+	}
+	for _, url := range urls {
+		id := kotatsu.GenerateUid(source, url)
+		chapter := url + "chapter-1/"
+		chapterID := kotatsu.GenerateUid(source, chapter)
+		m := kotatsu.KotatsuManga{Id: id, Title: "Manga " + url, Url: url, Source: source,
+			Tags: []interface{}{map[string]interface{}{"key": "action", "source": source, "title": "Action"}}}
+		kb.Favourites = append(kb.Favourites, kotatsu.KotatsuFavouriteEntry{MangaId: id, CategoryId: 1, Manga: m})
+		kb.Index = append(kb.Index, kotatsu.KotatsuIndexEntry{MangaId: id, Chapters: []kotatsu.KotatsuChapter{{Id: chapterID, Name: "Chapter 1", Url: chapter}}})
+		kb.History = append(kb.History, kotatsu.KotatsuHistory{MangaId: id, ChapterId: chapterID, Page: 2, Manga: &m})
+		kb.Bookmarks = append(kb.Bookmarks, kotatsu.KotatsuBookmark{MangaId: id, ChapterId: chapterID, Page: 2,
+			PageId: kotatsu.GenerateUid(source, fmt.Sprintf("%s#%d", chapter, 2))})
+		kb.Scrobbling = append(kb.Scrobbling, kotatsu.KotatsuScrobbling{Scrobbler: 2, MangaId: id, TargetId: 5})
+	}
+	return kb
+}
+
+func TestMigrateKotatsuSourceRoundTrip(t *testing.T) {
+	kb := testKotatsuBackup("NIGHTSCANS", "/series/one/", "/series/two/")
+	want := testKotatsuBackup("QISCANS", "/series/one/", "/series/two/")
+
+	report, err := MigrateKotatsuSource(kb, KotatsuMigration{From: "NIGHTSCANS", To: "QISCANS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 2 || report.UnknownChapters != 0 || len(report.Warnings) != 0 {
+		t.Errorf("report = %+v, want 2 manga migrated without warnings", report)
+	}
+	if !reflect.DeepEqual(kb, want) {
+		t.Errorf("migrated backup differs from one built on the target:\ngot  %+v\nwant %+v", kb, want)
+	}
+
+	if _, err := MigrateKotatsuSource(kb, KotatsuMigration{From: "QISCANS", To: "NIGHTSCANS"}); err != nil {
+		t.Fatal(err)
+	}
+	if original := testKotatsuBackup("NIGHTSCANS", "/series/one/", "/series/two/"); !reflect.DeepEqual(kb, original) {
+		t.Errorf("migrating back changed the backup:\ngot  %+v\nwant %+v", kb, original)
+	}
+}
+
+func TestMigrateKotatsuSourceStaleChapters(t *testing.T) {
+	kb := testKotatsuBackup("NIGHTSCANS", "/series/one/", "/series/two/", "/series/three/")
+	oldChapter := kb.History[0].ChapterId
+	kb.Index = kb.Index[1:]        // the first manga has no chapter index
+	kb.Bookmarks[1].ChapterId = 42 // a chapter missing from the second manga's index
+	// the third manga is already on the target parser and stays
+	onTarget := testKotatsuBackup("QISCANS", "/series/three/")
+	kb.Favourites = append(kb.Favourites, onTarget.Favourites...)
+
+	report, err := MigrateKotatsuSource(kb, KotatsuMigration{From: "NIGHTSCANS", To: "QISCANS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 2 || len(report.NotMigrated) != 1 {
+		t.Fatalf("migrated %d, left %v; want 2 migrated and 1 left", report.Migrated, report.NotMigrated)
+	}
+	wantWarnings := []string{
+		"Manga /series/one/: history of chapter",
+		"Manga /series/one/: bookmark on page 2 of chapter",
+		"Manga /series/two/: bookmark on page 2 of chapter 42 keeps its old ID, the chapter is not in the chapter index",
+	}
+	if report.UnknownChapters != len(wantWarnings) || len(report.Warnings) != len(wantWarnings) {
+		t.Fatalf("unknown chapters = %d, warnings = %q; want %d each", report.UnknownChapters, report.Warnings, len(wantWarnings))
+	}
+	for i, w := range report.Warnings {
+		if !strings.HasPrefix(w, wantWarnings[i]) {
+			t.Errorf("warning %d = %q, want it to start with %q", i, w, wantWarnings[i])
+		}
+	}
+	if !strings.HasSuffix(report.Warnings[0], "the manga has no chapter index") {
+		t.Errorf("warning %q does not say the manga has no chapter index", report.Warnings[0])
+	}
+
+	if got := kb.History[0].ChapterId; got != oldChapter {
+		t.Errorf("history chapter ID = %d, want the old ID %d", got, oldChapter)
+	}
+	if got, want := kb.History[0].MangaId, kotatsu.GenerateUid("QISCANS", "/series/one/"); got != want {
+		t.Errorf("history manga ID = %d, want %d", got, want)
+	}
+	if got := kb.Bookmarks[1].ChapterId; got != 42 {
+		t.Errorf("bookmark chapter ID = %d, want the old ID 42", got)
+	}
+	// the parser keeps a manga, so its settings are not renamed
+	if !strings.Contains(string(kb.RawSources), "NIGHTSCANS") {
+		t.Errorf("sources = %s, want NIGHTSCANS kept", kb.RawSources)
+	}
+}
@@ -0,0 +1,173 @@
+package convert
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// UnmappedPolicy decides what happens to manga whose source cannot be mapped
+type UnmappedPolicy string
+
+const (
+	// UnmappedDrop removes the manga (the historical behaviour)
+	UnmappedDrop UnmappedPolicy = "drop"
+	// UnmappedKeep keeps the manga with a hashed (Mihon) or placeholder (Kotatsu) source
+	UnmappedKeep UnmappedPolicy = "keep"
+	// UnmappedCategory keeps the manga and adds it to an "Unmapped (source X)" category
+	UnmappedCategory UnmappedPolicy = "category"
+	// UnmappedQuarantine removes the manga from the backup and hands it back for a side-car file
+	UnmappedQuarantine UnmappedPolicy = "quarantine"
+)
+
+// UnmappedPolicies lists the accepted policy names
+var UnmappedPolicies = []UnmappedPolicy{UnmappedDrop, UnmappedKeep, UnmappedCategory, UnmappedQuarantine}
+
+// ParseUnmappedPolicy validates a policy name; an empty name means UnmappedDrop
+func ParseUnmappedPolicy(s string) (UnmappedPolicy, error) {
+	if s == "" {
+		return UnmappedDrop, nil
+	}
+	for _, p := range UnmappedPolicies {
+		if string(p) == strings.ToLower(s) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown unmapped policy %q", s)
+}
+
+// Options control a conversion
+type Options struct {
+	// AllowSourceFallback hashes Kotatsu sources without a known mapping instead of failing.
+	// It is implied by every Unmapped policy other than UnmappedDrop.
+	AllowSourceFallback bool
+	// Unmapped decides what happens to manga whose source cannot be mapped
+	Unmapped UnmappedPolicy
+	// MinDomainConfidence is the confidence a DomainMatch needs to be applied;
+	// weaker matches are only reported. Zero means ConfidenceExact.
+	MinDomainConfidence float64
+	// DryRun only plans the conversion: sources without a mapping are hashed even
+	// without AllowSourceFallback so the plan can list what would be dropped
+	DryRun bool
+}
+
+func (o Options) minDomainConfidence() float64 {
+	if o.MinDomainConfidence <= 0 {
+		return ConfidenceExact
+	}
+	return o.MinDomainConfidence
+}
+
+func (o Options) allowFallback() bool {
+	return o.AllowSourceFallback || o.DryRun || (o.Unmapped != "" && o.Unmapped != UnmappedDrop)
+}
+
+// QuarantinedManga is a manga removed by UnmappedQuarantine, kept in full so it can be fixed up later
+type QuarantinedManga struct {
+	DroppedManga
+	Manga *pb.BackupManga `json:"-"`
+}
+
+// unmappedCategoryName is the category used by UnmappedCategory
+func unmappedCategoryName(sourceName string, sourceID int64) string {
+	if sourceName == "" {
+		sourceName = strconv.FormatInt(sourceID, 10)
+	}
+	return fmt.Sprintf("Unmapped (source %s)", sourceName)
+}
+
+// ApplyPolicy carries out the plan on b according to policy. Apply is equivalent
+// to ApplyPolicy with UnmappedDrop. Manga that stay in the backup despite having
+// no mapping are returned as kept; UnmappedQuarantine returns the removed manga
+// as quarantined in addition to dropped.
+func (p *FilterPlan) ApplyPolicy(b *pb.Backup, policy UnmappedPolicy) (dropped, kept []DroppedManga, quarantined []QuarantinedManga) {
+	switch policy {
+	case "", UnmappedDrop:
+		return p.Apply(b), nil, nil
+	case UnmappedQuarantine:
+		dropped = make([]DroppedManga, len(p.Dropped))
+		for i, m := range p.droppedOrder {
+			d := p.Dropped[i]
+			d.Reason += " (quarantined)"
+			dropped[i] = d
+			quarantined = append(quarantined, QuarantinedManga{DroppedManga: d, Manga: m})
+		}
+		p.Apply(b)
+		return dropped, nil, quarantined
+	}
+
+	// UnmappedKeep and UnmappedCategory leave the backup's manga and sources in place
+	kept = p.Dropped
+	if policy != UnmappedCategory {
+		return nil, kept, nil
+	}
+
+	// Mihon lists a manga's categories by order
+	var nextID, nextOrder int64
+	categoryOrders := make(map[string]int64)
+	for _, c := range b.BackupCategories {
+		nextID = max(nextID, c.GetId()+1)
+		nextOrder = max(nextOrder, c.GetOrder()+1)
+		categoryOrders[c.GetName()] = c.GetOrder()
+	}
+	for i, m := range p.droppedOrder {
+		name := unmappedCategoryName(p.Dropped[i].Source, m.GetSource())
+		order, exists := categoryOrders[name]
+		if !exists {
+			order = nextOrder
+			nextOrder++
+			b.BackupCategories = append(b.BackupCategories, &pb.BackupCategory{
+				Name:  stringPtr(name),
+				Order: int64Ptr(order),
+				Id:    int64Ptr(nextID),
+				Flags: int64Ptr(0),
+			})
+			nextID++
+			categoryOrders[name] = order
+		}
+		if !slices.Contains(m.Categories, order) {
+			m.Categories = append(m.Categories, order)
+		}
+	}
+	return nil, kept, nil
+}
+
+// WriteQuarantine writes quarantined manga as "json" (full manga data) or "csv" (one summary row per manga)
+func WriteQuarantine(w io.Writer, format string, quarantined []QuarantinedManga) error {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"Title", "Url", "SourceID", "Source", "Reason", "Rule"})
+		for _, q := range quarantined {
+			cw.Write([]string{q.Title, q.Url, strconv.FormatInt(q.SourceID, 10), q.Source, q.Reason, q.Rule})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		type entry struct {
+			DroppedManga
+			Manga json.RawMessage `json:"manga"`
+		}
+		entries := make([]entry, 0, len(quarantined))
+		for _, q := range quarantined {
+			raw, err := protojson.Marshal(q.Manga)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry{DroppedManga: q.DroppedManga, Manga: raw})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	default:
+		return fmt.Errorf("unknown quarantine format %q (expected json or csv)", format)
+	}
+}
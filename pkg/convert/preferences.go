@@ -0,0 +1,251 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/galpt/mk-bkconv/pkg/mihon"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+)
+
+// preferenceRule translates one app setting between a Mihon preference key and a
+// Kotatsu settings key. toKotatsu / toMihon return false when a value has no
+// equivalent. Values are the Go types of the Mihon preference (int32, int64,
+// float32, string, bool, []string) and plain JSON values on the Kotatsu side.
+type preferenceRule struct {
+	mihonKey   string
+	kotatsuKey string
+	toKotatsu  func(v any) (any, bool)
+	toMihon    func(v any) (any, bool)
+}
+
+// Mihon ReadingMode flag values
+const (
+	mihonReadingLeftToRight        int32 = 1
+	mihonReadingRightToLeft        int32 = 2
+	mihonReadingVertical           int32 = 3
+	mihonReadingWebtoon            int32 = 4
+	mihonReadingContinuousVertical int32 = 5
+)
+
+// preferenceRules is the translation table. Mihon's reading mode also carries the
+// paging direction, which Kotatsu expresses as STANDARD (left to right) vs REVERSED.
+var preferenceRules = []preferenceRule{
+	{
+		mihonKey:   "pref_default_reading_mode_key",
+		kotatsuKey: "reader_mode",
+		toKotatsu: enumToKotatsu(map[int32]string{
+			mihonReadingLeftToRight:        "STANDARD",
+			mihonReadingRightToLeft:        "REVERSED",
+			mihonReadingVertical:           "VERTICAL",
+			mihonReadingWebtoon:            "WEBTOON",
+			mihonReadingContinuousVertical: "WEBTOON",
+		}),
+		toMihon: enumToMihon(map[string]int32{
+			"STANDARD": mihonReadingLeftToRight,
+			"REVERSED": mihonReadingRightToLeft,
+			"VERTICAL": mihonReadingVertical,
+			"WEBTOON":  mihonReadingWebtoon,
+		}),
+	},
+	{
+		// Kotatsu stores AppCompatDelegate night modes as strings
+		mihonKey:   "pref_theme_mode_key",
+		kotatsuKey: "theme",
+		toKotatsu:  enumToKotatsu(map[string]string{"SYSTEM": "-1", "LIGHT": "1", "DARK": "2"}),
+		toMihon:    enumToMihon(map[string]string{"-1": "SYSTEM", "1": "LIGHT", "2": "DARK"}),
+	},
+	{
+		mihonKey:   "pref_app_theme",
+		kotatsuKey: "color_theme",
+		toKotatsu:  enumToKotatsu(map[string]string{"DEFAULT": "DEFAULT", "MONET": "MONET"}),
+		toMihon:    enumToMihon(map[string]string{"DEFAULT": "DEFAULT", "MONET": "MONET"}),
+	},
+	{
+		mihonKey:   "pref_theme_dark_amoled_key",
+		kotatsuKey: "amoled_theme",
+		toKotatsu:  sameBool,
+		toMihon:    sameBool,
+	},
+	{
+		// Kotatsu only knows a Wi-Fi restriction for its update checks; without it
+		// Mihon's other restrictions (charging, battery) are unknown and left alone
+		mihonKey:   "library_update_restriction",
+		kotatsuKey: "tracker_wifi",
+		toKotatsu: func(v any) (any, bool) {
+			set, ok := v.([]string)
+			if !ok {
+				return nil, false
+			}
+			return slices.Contains(set, "wifi") || slices.Contains(set, "network_not_metered"), true
+		},
+		toMihon: func(v any) (any, bool) {
+			wifi, ok := v.(bool)
+			if !ok || !wifi {
+				return nil, false
+			}
+			return []string{"wifi"}, true
+		},
+	},
+	{
+		// An update interval of 0 hours disables automatic updates in Mihon. Kotatsu
+		// has no interval, so enabled updates are left to Mihon's own setting.
+		mihonKey:   "pref_library_update_interval_key",
+		kotatsuKey: "tracker_enabled",
+		toKotatsu: func(v any) (any, bool) {
+			hours, ok := v.(int32)
+			if !ok {
+				return nil, false
+			}
+			return hours > 0, true
+		},
+		toMihon: func(v any) (any, bool) {
+			enabled, ok := v.(bool)
+			if !ok || enabled {
+				return nil, false
+			}
+			return int32(0), true
+		},
+	},
+	{
+		mihonKey:   "pref_download_only_over_wifi_key",
+		kotatsuKey: "downloads_wifi",
+		toKotatsu:  sameBool,
+		toMihon:    sameBool,
+	},
+}
+
+func sameBool(v any) (any, bool) {
+	b, ok := v.(bool)
+	return b, ok
+}
+
+func enumToKotatsu[K comparable](m map[K]string) func(any) (any, bool) {
+	return func(v any) (any, bool) {
+		k, ok := v.(K)
+		if !ok {
+			return nil, false
+		}
+		out, ok := m[k]
+		return out, ok
+	}
+}
+
+func enumToMihon[V any](m map[string]V) func(any) (any, bool) {
+	return func(v any) (any, bool) {
+		var s string
+		switch t := v.(type) {
+		case string:
+			s = t
+		case float64:
+			// numeric settings may have been written without quotes
+			s = strconv.FormatFloat(t, 'f', -1, 64)
+		default:
+			return nil, false
+		}
+		out, ok := m[s]
+		return out, ok
+	}
+}
+
+// mihonPreferencesToKotatsu translates app preferences into Kotatsu's settings
+// section (an array holding one object) and returns the untranslated keys
+func mihonPreferencesToKotatsu(prefs []*pb.BackupPreference) (json.RawMessage, []string) {
+	rules := make(map[string]preferenceRule, len(preferenceRules))
+	for _, r := range preferenceRules {
+		rules[r.mihonKey] = r
+	}
+	settings := make(map[string]any)
+	var untranslated []string
+	for _, p := range prefs {
+		rule, ok := rules[p.GetKey()]
+		if !ok {
+			untranslated = append(untranslated, p.GetKey())
+			continue
+		}
+		v, err := mihon.PreferenceGoValue(p.GetValue())
+		if err != nil {
+			untranslated = append(untranslated, p.GetKey())
+			continue
+		}
+		out, ok := rule.toKotatsu(v)
+		if !ok {
+			untranslated = append(untranslated, p.GetKey())
+			continue
+		}
+		settings[rule.kotatsuKey] = out
+	}
+	sort.Strings(untranslated)
+	if len(settings) == 0 {
+		return nil, untranslated
+	}
+	raw, err := json.Marshal([]map[string]any{settings})
+	if err != nil {
+		return nil, untranslated
+	}
+	return raw, untranslated
+}
+
+// kotatsuSettingsToMihon translates Kotatsu's settings section into app
+// preferences and returns the untranslated keys
+func kotatsuSettingsToMihon(raw json.RawMessage) ([]*pb.BackupPreference, []string, error) {
+	settings, err := parseKotatsuSettings(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	rules := make(map[string]preferenceRule, len(preferenceRules))
+	for _, r := range preferenceRules {
+		rules[r.kotatsuKey] = r
+	}
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var prefs []*pb.BackupPreference
+	var untranslated []string
+	for _, k := range keys {
+		rule, ok := rules[k]
+		if !ok {
+			untranslated = append(untranslated, k)
+			continue
+		}
+		out, ok := rule.toMihon(settings[k])
+		if !ok {
+			untranslated = append(untranslated, k)
+			continue
+		}
+		pref, err := mihon.NewPreference(rule.mihonKey, out)
+		if err != nil {
+			return nil, nil, err
+		}
+		prefs = append(prefs, pref)
+	}
+	return prefs, untranslated, nil
+}
+
+// parseKotatsuSettings accepts the settings section as an array of objects (as
+// Kotatsu writes it) or as a single object
+func parseKotatsuSettings(raw json.RawMessage) (map[string]any, error) {
+	settings := make(map[string]any)
+	if len(raw) == 0 {
+		return settings, nil
+	}
+	var arr []map[string]any
+	if err := json.Unmarshal(raw, &arr); err == nil {
+		for _, obj := range arr {
+			for k, v := range obj {
+				settings[k] = v
+			}
+		}
+		return settings, nil
+	}
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		return nil, fmt.Errorf("decode settings: %w", err)
+	}
+	return settings, nil
+}
@@ -0,0 +1,115 @@
+package convert
+
+import (
+	"sort"
+
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+)
+
+// Conversion directions recorded in Report.Direction
+const (
+	DirectionKotatsuToMihon = "kotatsu-to-mihon"
+	DirectionMihonToKotatsu = "mihon-to-kotatsu"
+)
+
+// Report describes what a conversion did, so callers can decide how (and whether)
+// to present it instead of the library printing to stdout.
+type Report struct {
+	Direction      string         `json:"direction"`
+	DryRun         bool           `json:"dry_run,omitempty"`
+	ConvertedManga int            `json:"converted_manga"`
+	DroppedManga   []DroppedManga `json:"dropped_manga"`
+	// KeptUnmapped lists manga without a source mapping that were kept by the unmapped policy
+	KeptUnmapped []DroppedManga `json:"kept_unmapped"`
+	// Quarantined holds the manga removed by UnmappedQuarantine for writing a side-car file
+	Quarantined []QuarantinedManga `json:"-"`
+	Sources     []ReportSource     `json:"sources"`
+	// Fallbacks lists Kotatsu sources kept in the backup whose Mihon ID was
+	// derived by hashing because no known mapping exists
+	Fallbacks []string `json:"fallbacks"`
+	// SourceIDMismatches lists mapped sources whose published ID differs from the
+	// computed one; the published ID is used
+	SourceIDMismatches []SourceIDMismatch `json:"source_id_mismatches"`
+	// DomainMatches lists sources without a known mapping that were matched by website domain
+	DomainMatches []DomainMatch `json:"domain_matches"`
+	// UnmappedFields counts, per field, how many entries carried data the target format cannot hold
+	UnmappedFields map[string]int `json:"unmapped_fields"`
+	// UntranslatedPreferences lists app preference / settings keys without an equivalent in the target app
+	UntranslatedPreferences []string `json:"untranslated_preferences"`
+	Warnings                []string `json:"warnings"`
+	// ExtensionRepoAdded is set when the Keiyoushi repository was added to a Mihon backup
+	ExtensionRepoAdded bool `json:"extension_repo_added"`
+}
+
+// DroppedManga is a manga that was left out of the converted backup
+type DroppedManga struct {
+	Title    string `json:"title"`
+	Url      string `json:"url"`
+	SourceID int64  `json:"source_id,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Reason   string `json:"reason"`
+	// Rule is the mapping that would have been needed to keep the manga
+	Rule string `json:"rule,omitempty"`
+}
+
+// ReportSource is a source present in the converted backup
+type ReportSource struct {
+	Name       string `json:"name"`
+	ID         int64  `json:"id,omitempty"`
+	Kotatsu    string `json:"kotatsu,omitempty"`
+	MangaCount int    `json:"manga_count"`
+	// Extension is the package providing the source according to KeiyoushiIndex
+	Extension string `json:"extension,omitempty"`
+}
+
+func newReport(direction string) *Report {
+	return &Report{
+		Direction:               direction,
+		DroppedManga:            []DroppedManga{},
+		KeptUnmapped:            []DroppedManga{},
+		Sources:                 []ReportSource{},
+		Fallbacks:               []string{},
+		SourceIDMismatches:      []SourceIDMismatch{},
+		DomainMatches:           []DomainMatch{},
+		UnmappedFields:          make(map[string]int),
+		UntranslatedPreferences: []string{},
+		Warnings:                []string{},
+	}
+}
+
+// applyPlan carries out a filter plan and records the outcome
+func (r *Report) applyPlan(p *FilterPlan, b *pb.Backup, policy UnmappedPolicy) {
+	dropped, kept, quarantined := p.ApplyPolicy(b, policy)
+	r.DroppedManga = append(r.DroppedManga, dropped...)
+	r.KeptUnmapped = append(r.KeptUnmapped, kept...)
+	r.Quarantined = append(r.Quarantined, quarantined...)
+}
+
+// checkSourceID records a mismatch between the computed and published ID of a mapped source once
+func (r *Report) checkSourceID(kotatsuSource string) {
+	mismatch, ok := CheckSourceID(kotatsuSource)
+	if !ok {
+		return
+	}
+	for _, m := range r.SourceIDMismatches {
+		if m.Kotatsu == kotatsuSource {
+			return
+		}
+	}
+	r.SourceIDMismatches = append(r.SourceIDMismatches, mismatch)
+}
+
+// unmapped records that a field could not be carried over for one entry
+func (r *Report) unmapped(field string) {
+	r.UnmappedFields[field]++
+}
+
+// UnmappedFieldNames returns the unmapped field names in a stable order
+func (r *Report) UnmappedFieldNames() []string {
+	names := make([]string, 0, len(r.UnmappedFields))
+	for name := range r.UnmappedFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -3,6 +3,7 @@ package convert
 import (
 	"crypto/md5"
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -22,6 +23,15 @@ var KnownSourceMapping = map[string]SourceMapping{
 		MihonLang:      "all",
 		MihonVersionID: 1,
 		Notes:          "Official MangaDex source",
+		// Kotatsu stores the bare UUIDs, the extension "/manga/<uuid>" and "/chapter/<uuid>"
+		URLs: &URLTransform{
+			BaseURL: "https://mangadex.org",
+			Mihon: URLStyle{
+				MangaPrefix:   "/manga/",
+				ChapterPrefix: "/chapter/",
+				IDPattern:     `^/(?:manga|title|chapter)/([0-9a-fA-F-]{36})`,
+			},
+		},
 	},
 	"MANGAPARK": {
 		MihonName:      "MangaPark",
@@ -549,6 +559,9 @@ type SourceMapping struct {
 	MihonLang      string // Language code (e.g., "en", "all")
 	MihonVersionID int    // Version ID (usually 1)
 	Notes          string // Additional notes for users
+	// URLs rewrites manga and chapter URLs when the parser and the extension
+	// store them differently; nil copies URLs verbatim
+	URLs *URLTransform
 }
 
 // GenerateMihonSourceID generates a source ID using Mihon's algorithm:
@@ -572,11 +585,126 @@ func GenerateMihonSourceID(name, lang string, versionID int) int64 {
 	return id
 }
 
-// LookupKnownSource attempts to find a known Mihon mapping for a Kotatsu source
+// LookupKnownSource attempts to find a known Mihon mapping for a Kotatsu source.
+// The ID published in KeiyoushiIndex is preferred over the computed one.
 func LookupKnownSource(kotatsuSource string) (sourceID int64, sourceName string, found bool) {
 	if mapping, exists := KnownSourceMapping[kotatsuSource]; exists {
-		id := GenerateMihonSourceID(mapping.MihonName, mapping.MihonLang, mapping.MihonVersionID)
+		id, _ := mapping.SourceID()
 		return id, mapping.MihonName, true
 	}
 	return 0, "", false
 }
+
+// SourceID returns the Mihon source ID of the mapping. Extensions may override
+// their ID, so the ID published in KeiyoushiIndex for the same name and lang wins;
+// GenerateMihonSourceID is only used when the index has no entry.
+func (m SourceMapping) SourceID() (id int64, published bool) {
+	if s, ok := FindIndexedSource(m.MihonName, m.MihonLang); ok {
+		return s.ID, true
+	}
+	return GenerateMihonSourceID(m.MihonName, m.MihonLang, m.MihonVersionID), false
+}
+
+// knownSourceIDs returns every ID a backup may use for the mapping: the
+// resolved one first and the computed one when the index publishes another.
+// Backups written before the index was consulted carry the computed ID.
+func (m SourceMapping) knownSourceIDs() []int64 {
+	id, published := m.SourceID()
+	if !published {
+		return []int64{id}
+	}
+	computed := GenerateMihonSourceID(m.MihonName, m.MihonLang, m.MihonVersionID)
+	if computed == id {
+		return []int64{id}
+	}
+	return []int64{id, computed}
+}
+
+// SourceIDMismatch is a mapping whose computed source ID differs from the one
+// published in the extension index
+type SourceIDMismatch struct {
+	Kotatsu     string `json:"kotatsu"`
+	MihonName   string `json:"mihon_name"`
+	MihonLang   string `json:"mihon_lang"`
+	ComputedID  int64  `json:"computed_id"`
+	PublishedID int64  `json:"published_id"`
+}
+
+// CheckSourceID reports whether the computed ID of a KnownSourceMapping entry
+// disagrees with the extension index
+func CheckSourceID(kotatsuSource string) (SourceIDMismatch, bool) {
+	m, exists := KnownSourceMapping[kotatsuSource]
+	if !exists {
+		return SourceIDMismatch{}, false
+	}
+	published, ok := m.SourceID()
+	if !ok {
+		return SourceIDMismatch{}, false
+	}
+	computed := GenerateMihonSourceID(m.MihonName, m.MihonLang, m.MihonVersionID)
+	if computed == published {
+		return SourceIDMismatch{}, false
+	}
+	return SourceIDMismatch{
+		Kotatsu:     kotatsuSource,
+		MihonName:   m.MihonName,
+		MihonLang:   m.MihonLang,
+		ComputedID:  computed,
+		PublishedID: published,
+	}, true
+}
+
+// knownSourceKeys returns the KnownSourceMapping keys in sorted order
+func knownSourceKeys() []string {
+	keys := make([]string, 0, len(KnownSourceMapping))
+	for k := range KnownSourceMapping {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ReverseSourceIndex maps Mihon sources back to the Kotatsu parser names in KnownSourceMapping
+type ReverseSourceIndex struct {
+	byID   map[int64]string
+	byName map[string]string
+}
+
+// NewReverseSourceIndex builds a reverse index from the current KnownSourceMapping.
+// When several Kotatsu parsers map to the same Mihon source the alphabetically
+// first key wins so results are deterministic.
+func NewReverseSourceIndex() *ReverseSourceIndex {
+	keys := knownSourceKeys()
+	r := &ReverseSourceIndex{
+		byID:   make(map[int64]string, len(keys)),
+		byName: make(map[string]string, len(keys)),
+	}
+	for _, k := range keys {
+		m := KnownSourceMapping[k]
+		for _, id := range m.knownSourceIDs() {
+			if _, exists := r.byID[id]; !exists {
+				r.byID[id] = k
+			}
+		}
+		name := strings.ToLower(m.MihonName)
+		if _, exists := r.byName[name]; !exists {
+			r.byName[name] = k
+		}
+	}
+	return r
+}
+
+// Lookup returns the Kotatsu parser name for a Mihon source. The source ID is tried
+// first; sourceName (as found in BackupSources) is used when the ID is unknown,
+// e.g. because the extension uses a different lang or versionId.
+func (r *ReverseSourceIndex) Lookup(sourceID int64, sourceName string) (kotatsuSource string, found bool) {
+	if k, ok := r.byID[sourceID]; ok {
+		return k, true
+	}
+	if sourceName != "" {
+		if k, ok := r.byName[strings.ToLower(sourceName)]; ok {
+			return k, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,167 @@
+package convert
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/galpt/mk-bkconv/pkg/kotatsu"
+	"github.com/galpt/mk-bkconv/pkg/mihon"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+)
+
+// MihonToKotatsuStream is MihonToKotatsu for libraries too large to decode at
+// once. open must return the Mihon backup from the start each time; it is read
+// three times with mihon.StreamBackupFrom. The first pass only keeps what
+// planning needs from each manga (source, URL, title and categories), the
+// second writes the favourites and the third the chapter index, one manga at a
+// time. History, bookmarks and tracking entries are collected and written at
+// the end. Memory therefore grows with the number of manga by a small record
+// each, but not with their metadata or chapters. w is not closed.
+func MihonToKotatsuStream(open func() (io.ReadCloser, error), w *kotatsu.ZipStreamWriter, opts Options) (*Report, error) {
+	report := newReport(DirectionMihonToKotatsu)
+
+	var library []*pb.BackupManga
+	b, err := streamMihon(open, func(m *pb.BackupManga) error {
+		library = append(library, &pb.BackupManga{
+			Source:     m.Source,
+			Url:        m.Url,
+			Title:      m.Title,
+			Categories: m.Categories,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.BackupManga = slices.Clone(library)
+	report.applyPlan(PlanFilterMihonForKotatsu(b), b, opts.Unmapped)
+
+	// kept[i] is the position among the converted manga of the i-th manga of the backup,
+	// quarantined[i] its entry in report.Quarantined; the full manga is picked up below
+	kept := make([]int, len(library))
+	quarantined := make([]int, len(library))
+	for i := range library {
+		kept[i], quarantined[i] = -1, -1
+	}
+	position := make(map[*pb.BackupManga]int, len(library))
+	for i, m := range library {
+		position[m] = i
+	}
+	for i, m := range b.BackupManga {
+		kept[position[m]] = i
+	}
+	for i, q := range report.Quarantined {
+		quarantined[position[q.Manga]] = i
+	}
+	position = nil
+
+	type target struct {
+		source string
+		found  bool
+	}
+	targets := make([]target, len(b.BackupManga))
+	c := newMihonToKotatsu(b, report)
+	for i, m := range b.BackupManga {
+		targets[i].source, targets[i].found = c.lookupSource(m)
+	}
+	report.ConvertedManga = len(b.BackupManga)
+
+	// each pass must see the same manga as the first
+	pass := func(fn func(i int, m *pb.BackupManga) error) error {
+		n := 0
+		_, err := streamMihon(open, func(m *pb.BackupManga) error {
+			if n >= len(library) {
+				return fmt.Errorf("backup changed between passes: more than %d manga", len(library))
+			}
+			n++
+			return fn(n-1, m)
+		})
+		if err == nil && n != len(library) {
+			err = fmt.Errorf("backup changed between passes: %d manga, then %d", len(library), n)
+		}
+		return err
+	}
+
+	err = pass(func(i int, m *pb.BackupManga) error {
+		if q := quarantined[i]; q >= 0 {
+			report.Quarantined[q].Manga = m
+		}
+		k := kept[i]
+		if k < 0 {
+			return nil
+		}
+		// the unmapped policy may have added a category
+		m.Categories = library[i].Categories
+		for _, f := range c.favourites(k, m, targets[k].source, targets[k].found) {
+			if err := w.Append(kotatsu.SectionFavourites, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	kb := &kotatsu.KotatsuBackup{}
+	err = pass(func(i int, m *pb.BackupManga) error {
+		k := kept[i]
+		if k < 0 {
+			return nil
+		}
+		t := targets[k]
+		idx, hist, bookmarks, scrobbling := c.chapters(m, t.source, t.found, kotatsuManga(m, t.source, t.found))
+		if len(idx.Chapters) > 0 {
+			if err := w.Append(kotatsu.SectionIndex, idx); err != nil {
+				return err
+			}
+		}
+		if hist != nil {
+			kb.History = append(kb.History, *hist)
+		}
+		kb.Bookmarks = append(kb.Bookmarks, bookmarks...)
+		kb.Scrobbling = append(kb.Scrobbling, scrobbling...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.settings(b, kb)
+	if err := appendSection(w, kotatsu.SectionCategories, kb.Categories); err != nil {
+		return nil, err
+	}
+	if err := appendSection(w, kotatsu.SectionHistory, kb.History); err != nil {
+		return nil, err
+	}
+	if err := appendSection(w, kotatsu.SectionBookmarks, kb.Bookmarks); err != nil {
+		return nil, err
+	}
+	if err := appendSection(w, kotatsu.SectionScrobbling, kb.Scrobbling); err != nil {
+		return nil, err
+	}
+	if err := w.WriteRaw(kotatsu.SectionSettings, kb.RawSettings); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// streamMihon makes one pass over the backup returned by open
+func streamMihon(open func() (io.ReadCloser, error), onManga func(*pb.BackupManga) error) (*pb.Backup, error) {
+	rc, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return mihon.StreamBackupFrom(rc, onManga)
+}
+
+func appendSection[T any](w *kotatsu.ZipStreamWriter, section string, items []T) error {
+	for _, v := range items {
+		if err := w.Append(section, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package convert
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/galpt/mk-bkconv/pkg/kotatsu"
+	"github.com/galpt/mk-bkconv/pkg/mihon"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMihonToKotatsuStreamMatchesMihonToKotatsu(t *testing.T) {
+	mangapark, _ := KnownSourceMapping["MANGAPARK"].SourceID()
+	mangadex, _ := KnownSourceMapping["MANGADEX"].SourceID()
+	const unmapped = 77
+
+	read := testMihonManga(mangapark, "/title/1",
+		testMihonChapter("/c/2", 0, false, 4),
+		testMihonChapter("/c/1", 1, true, 0),
+	)
+	read.Favorite = boolPtr(true)
+	read.Categories = []int64{1}
+	read.Chapters[0].Bookmark = boolPtr(true)
+	read.History = []*pb.BackupHistory{{Url: stringPtr("/c/2"), LastRead: int64Ptr(1000)}}
+	read.Tracking = []*pb.BackupTracking{{SyncId: int32Ptr(2), LibraryId: int64Ptr(5), MediaId: int64Ptr(9), LastChapterRead: float32Ptr(1)}}
+	b := &pb.Backup{
+		BackupManga: []*pb.BackupManga{
+			read,
+			testMihonManga(unmapped, "/lost"),
+			testMihonManga(mangadex, "/manga/9a4ef1c5-8a3e-4b2f-9c8d-1e2f3a4b5c6d", testMihonChapter("/chapter/0b1c2d3e-4f50-6172-8394-a5b6c7d8e9f0", 0, true, 0)),
+		},
+		BackupCategories: []*pb.BackupCategory{{Name: stringPtr("Reading"), Order: int64Ptr(1), Id: int64Ptr(1)}},
+		BackupSources: []*pb.BackupSource{
+			{SourceId: int64Ptr(mangapark), Name: stringPtr("MangaPark")},
+			{SourceId: int64Ptr(mangadex), Name: stringPtr("MangaDex")},
+			{SourceId: int64Ptr(unmapped), Name: stringPtr("Lost")},
+		},
+	}
+	var backup bytes.Buffer
+	if err := mihon.WriteBackupTo(&backup, b); err != nil {
+		t.Fatal(err)
+	}
+	info := &kotatsu.KotatsuBackupInfo{AppId: kotatsu.DefaultAppId, AppVersion: kotatsu.DefaultAppVersion, CreatedAt: 1}
+
+	for _, policy := range UnmappedPolicies {
+		t.Run(string(policy), func(t *testing.T) {
+			opts := Options{Unmapped: policy}
+
+			kb, want := MihonToKotatsu(proto.Clone(b).(*pb.Backup), opts)
+			kb.Info = info
+			var buf bytes.Buffer
+			if err := kotatsu.WriteKotatsuZipTo(&buf, kb); err != nil {
+				t.Fatal(err)
+			}
+			wantZip, err := kotatsu.ReadKotatsuZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf.Reset()
+			w := kotatsu.NewZipStreamWriter(&buf)
+			w.Info = info
+			got, err := MihonToKotatsuStream(func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(backup.Bytes())), nil
+			}, w, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			gotZip, err := kotatsu.ReadKotatsuZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(wantZip.Favourites) == 0 || len(wantZip.Index) == 0 || len(wantZip.Bookmarks) == 0 {
+				t.Fatalf("MihonToKotatsu converted too little to compare: %+v", wantZip)
+			}
+			if policy == UnmappedQuarantine && len(want.Quarantined) != 1 {
+				t.Fatalf("MihonToKotatsu quarantined %d manga, want 1", len(want.Quarantined))
+			}
+			if !reflect.DeepEqual(gotZip, wantZip) {
+				t.Errorf("streamed backup differs:\ngot  %+v\nwant %+v", gotZip, wantZip)
+			}
+			if len(got.Quarantined) != len(want.Quarantined) {
+				t.Fatalf("got %d quarantined manga, want %d", len(got.Quarantined), len(want.Quarantined))
+			}
+			for i := range got.Quarantined {
+				if !proto.Equal(got.Quarantined[i].Manga, want.Quarantined[i].Manga) {
+					t.Errorf("quarantined manga %d = %v, want %v", i, got.Quarantined[i].Manga, want.Quarantined[i].Manga)
+				}
+			}
+			got.Quarantined, want.Quarantined = nil, nil
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("streamed report differs:\ngot  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestMihonToKotatsuStreamChangedBackup(t *testing.T) {
+	sourceID, _ := KnownSourceMapping["MANGAPARK"].SourceID()
+	backups := make([][]byte, 2)
+	for i, n := range []int{2, 1} {
+		b := &pb.Backup{BackupSources: []*pb.BackupSource{{SourceId: int64Ptr(sourceID), Name: stringPtr("MangaPark")}}}
+		for range n {
+			b.BackupManga = append(b.BackupManga, testMihonManga(sourceID, "/title/1"))
+		}
+		var buf bytes.Buffer
+		if err := mihon.WriteBackupTo(&buf, b); err != nil {
+			t.Fatal(err)
+		}
+		backups[i] = buf.Bytes()
+	}
+	pass := 0
+	_, err := MihonToKotatsuStream(func() (io.ReadCloser, error) {
+		data := backups[min(pass, 1)]
+		pass++
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, kotatsu.NewZipStreamWriter(io.Discard), Options{})
+	if err == nil {
+		t.Error("a backup that changed between passes was converted")
+	}
+}
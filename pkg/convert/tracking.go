@@ -0,0 +1,167 @@
+package convert
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/galpt/mk-bkconv/pkg/kotatsu"
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+)
+
+// Kotatsu ScrobblingStatus enum names
+const (
+	scrobblingPlanned   = "PLANNED"
+	scrobblingReading   = "READING"
+	scrobblingReReading = "RE_READING"
+	scrobblingCompleted = "COMPLETED"
+	scrobblingOnHold    = "ON_HOLD"
+	scrobblingDropped   = "DROPPED"
+)
+
+// trackerService describes a tracking service known to both apps
+type trackerService struct {
+	Name        string
+	KotatsuID   int     // Kotatsu ScrobblerService id
+	MihonSyncID int32   // Mihon tracker id
+	ScoreScale  float32 // Mihon score for a perfect rating; Kotatsu uses 0..1
+	URLFormat   string  // tracking URL, formatted with the remote manga id
+	// Statuses maps Kotatsu statuses to the tracker specific Mihon status values
+	Statuses map[string]int32
+}
+
+// trackerServices lists the services that can be converted. Mihon status values
+// differ per tracker, see the Tracker implementations in Mihon's data/track package.
+var trackerServices = []trackerService{
+	{
+		Name:        "MyAnimeList",
+		KotatsuID:   3,
+		MihonSyncID: 1,
+		ScoreScale:  10,
+		URLFormat:   "https://myanimelist.net/manga/%d",
+		Statuses: map[string]int32{
+			scrobblingReading:   1,
+			scrobblingCompleted: 2,
+			scrobblingOnHold:    3,
+			scrobblingDropped:   4,
+			scrobblingPlanned:   6,
+			scrobblingReReading: 7,
+		},
+	},
+	{
+		Name:        "AniList",
+		KotatsuID:   2,
+		MihonSyncID: 2,
+		ScoreScale:  100,
+		URLFormat:   "https://anilist.co/manga/%d",
+		Statuses: map[string]int32{
+			scrobblingReading:   1,
+			scrobblingCompleted: 2,
+			scrobblingOnHold:    3,
+			scrobblingDropped:   4,
+			scrobblingPlanned:   5,
+			scrobblingReReading: 6,
+		},
+	},
+	{
+		Name:        "Kitsu",
+		KotatsuID:   4,
+		MihonSyncID: 3,
+		ScoreScale:  10,
+		URLFormat:   "https://kitsu.app/manga/%d",
+		Statuses: map[string]int32{
+			scrobblingReading:   1,
+			scrobblingCompleted: 2,
+			scrobblingOnHold:    3,
+			scrobblingDropped:   4,
+			scrobblingPlanned:   5,
+		},
+	},
+	{
+		Name:        "Shikimori",
+		KotatsuID:   1,
+		MihonSyncID: 4,
+		ScoreScale:  10,
+		URLFormat:   "https://shikimori.one/mangas/%d",
+		Statuses: map[string]int32{
+			scrobblingReading:   1,
+			scrobblingCompleted: 2,
+			scrobblingOnHold:    3,
+			scrobblingDropped:   4,
+			scrobblingPlanned:   5,
+			scrobblingReReading: 6,
+		},
+	},
+}
+
+// trackerByKotatsuID finds a tracking service by Kotatsu ScrobblerService id
+func trackerByKotatsuID(id int) (trackerService, bool) {
+	for _, t := range trackerServices {
+		if t.KotatsuID == id {
+			return t, true
+		}
+	}
+	return trackerService{}, false
+}
+
+// trackerByMihonSyncID finds a tracking service by Mihon tracker id
+func trackerByMihonSyncID(id int32) (trackerService, bool) {
+	for _, t := range trackerServices {
+		if t.MihonSyncID == id {
+			return t, true
+		}
+	}
+	return trackerService{}, false
+}
+
+// kotatsuScrobblingToMihon converts a Kotatsu scrobbling record into Mihon tracking.
+// found is false when the service has no Mihon equivalent.
+func kotatsuScrobblingToMihon(s kotatsu.KotatsuScrobbling, title string) (t *pb.BackupTracking, found bool) {
+	svc, ok := trackerByKotatsuID(s.Scrobbler)
+	if !ok {
+		return nil, false
+	}
+	t = &pb.BackupTracking{
+		SyncId:          int32Ptr(svc.MihonSyncID),
+		LibraryId:       int64Ptr(s.Id),
+		MediaId:         int64Ptr(s.TargetId),
+		TrackingUrl:     stringPtr(fmt.Sprintf(svc.URLFormat, s.TargetId)),
+		Title:           stringPtr(title),
+		LastChapterRead: float32Ptr(float32(s.Chapter)),
+		Score:           float32Ptr(s.Rating * svc.ScoreScale),
+	}
+	if s.TargetId <= math.MaxInt32 {
+		t.MediaIdInt = int32Ptr(int32(s.TargetId))
+	}
+	if status, ok := svc.Statuses[s.Status]; ok {
+		t.Status = int32Ptr(status)
+	}
+	return t, true
+}
+
+// mihonTrackingToKotatsu converts Mihon tracking into a Kotatsu scrobbling record.
+// found is false when the tracker is not supported by Kotatsu.
+func mihonTrackingToKotatsu(t *pb.BackupTracking, mangaID int64) (s kotatsu.KotatsuScrobbling, found bool) {
+	svc, ok := trackerByMihonSyncID(t.GetSyncId())
+	if !ok {
+		return kotatsu.KotatsuScrobbling{}, false
+	}
+	targetID := t.GetMediaId()
+	if targetID == 0 {
+		targetID = int64(t.GetMediaIdInt())
+	}
+	s = kotatsu.KotatsuScrobbling{
+		Scrobbler: svc.KotatsuID,
+		Id:        t.GetLibraryId(),
+		MangaId:   mangaID,
+		TargetId:  targetID,
+		Chapter:   int(t.GetLastChapterRead()),
+		Rating:    min(max(t.GetScore()/svc.ScoreScale, 0), 1),
+	}
+	for status, v := range svc.Statuses {
+		if v == t.GetStatus() {
+			s.Status = status
+			break
+		}
+	}
+	return s, true
+}
@@ -0,0 +1,193 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+	"google.golang.org/protobuf/proto"
+)
+
+// URLStyle describes how one app stores the manga and chapter URLs of a source
+type URLStyle struct {
+	// Absolute URLs include scheme and host, otherwise only the path is stored
+	Absolute bool `json:"absolute,omitempty"`
+	// MangaPrefix and ChapterPrefix are the path prefixes in front of the part
+	// both apps share, e.g. "/manga/" in front of a MangaDex UUID
+	MangaPrefix   string `json:"manga_prefix,omitempty"`
+	ChapterPrefix string `json:"chapter_prefix,omitempty"`
+	// IDPattern extracts the shared part (first capture group) from a path. It is
+	// tried before the prefixes, e.g. `^/(?:manga|title)/([0-9a-f-]{36})`.
+	IDPattern string `json:"id_pattern,omitempty"`
+}
+
+// URLTransform converts manga and chapter URLs between a Kotatsu parser and a Mihon extension
+type URLTransform struct {
+	// BaseURL is the site root used to build absolute URLs, e.g. "https://mangadex.org"
+	BaseURL string   `json:"base_url,omitempty"`
+	Kotatsu URLStyle `json:"kotatsu"`
+	Mihon   URLStyle `json:"mihon"`
+}
+
+// URLKind selects the manga or chapter prefix of a URLStyle
+type URLKind int
+
+const (
+	MangaURL URLKind = iota
+	ChapterURL
+)
+
+func (s URLStyle) prefix(kind URLKind) string {
+	if kind == ChapterURL {
+		return s.ChapterPrefix
+	}
+	return s.MangaPrefix
+}
+
+// idPatterns caches compiled URLStyle.IDPattern expressions
+var idPatterns sync.Map
+
+func compileIDPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := idPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.NumSubexp() < 1 {
+		return nil, fmt.Errorf("id_pattern %q needs a capture group", pattern)
+	}
+	idPatterns.Store(pattern, re)
+	return re, nil
+}
+
+// extract returns the part of path shared by both apps
+func (s URLStyle) extract(path string, kind URLKind) (string, bool) {
+	if s.IDPattern != "" {
+		if re, err := compileIDPattern(s.IDPattern); err == nil {
+			if m := re.FindStringSubmatch(path); m != nil {
+				return m[1], true
+			}
+		}
+	}
+	prefix := s.prefix(kind)
+	if prefix == "" {
+		return path, true
+	}
+	if rest, ok := strings.CutPrefix(path, prefix); ok {
+		return rest, true
+	}
+	return "", false
+}
+
+// Validate checks the ID patterns and that absolute styles have a BaseURL
+func (t *URLTransform) Validate() error {
+	for _, s := range []URLStyle{t.Kotatsu, t.Mihon} {
+		if s.IDPattern != "" {
+			if _, err := compileIDPattern(s.IDPattern); err != nil {
+				return err
+			}
+		}
+	}
+	if (t.Kotatsu.Absolute || t.Mihon.Absolute) && t.BaseURL == "" {
+		return errors.New("base_url is required for absolute URLs")
+	}
+	return nil
+}
+
+// ToMihon converts a Kotatsu URL to the Mihon extension's format
+func (t *URLTransform) ToMihon(u string, kind URLKind) string {
+	return t.convert(u, kind, t.Kotatsu, t.Mihon)
+}
+
+// ToKotatsu converts a Mihon URL to the Kotatsu parser's format
+func (t *URLTransform) ToKotatsu(u string, kind URLKind) string {
+	return t.convert(u, kind, t.Mihon, t.Kotatsu)
+}
+
+// PublicURL returns an absolute URL for a Mihon manga URL
+func (t *URLTransform) PublicURL(mihonURL string) string {
+	if t.BaseURL == "" || mihonURL == "" || strings.Contains(mihonURL, "://") {
+		return mihonURL
+	}
+	return joinURL(t.BaseURL, mihonURL)
+}
+
+func (t *URLTransform) convert(u string, kind URLKind, from, to URLStyle) string {
+	if u == "" {
+		return u
+	}
+	path := stripHost(u)
+	out := path
+	// URLs that do not look like the source's format are only made absolute or relative
+	if key, ok := from.extract(path, kind); ok {
+		out = to.prefix(kind) + key
+	}
+	if to.Absolute && t.BaseURL != "" {
+		return joinURL(t.BaseURL, out)
+	}
+	return out
+}
+
+// stripHost removes scheme and host from an absolute URL
+func stripHost(u string) string {
+	if !strings.Contains(u, "://") && !strings.HasPrefix(u, "//") {
+		return u
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return u
+	}
+	path := parsed.EscapedPath()
+	if parsed.RawQuery != "" {
+		path += "?" + parsed.RawQuery
+	}
+	if parsed.Fragment != "" {
+		path += "#" + parsed.EscapedFragment()
+	}
+	return path
+}
+
+func joinURL(base, path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
+
+// urlTransformFor returns the URL transform of a Kotatsu source, or nil
+func urlTransformFor(kotatsuSource string) *URLTransform {
+	if m, ok := KnownSourceMapping[kotatsuSource]; ok {
+		return m.URLs
+	}
+	return nil
+}
+
+// rewriteURLsToMihon converts the manga, chapter and history URLs of a manga built from Kotatsu data in place
+func (t *URLTransform) rewriteURLsToMihon(m *pb.BackupManga) {
+	m.Url = stringPtr(t.ToMihon(m.GetUrl(), MangaURL))
+	for _, c := range m.Chapters {
+		c.Url = stringPtr(t.ToMihon(c.GetUrl(), ChapterURL))
+	}
+	for _, h := range m.History {
+		h.Url = stringPtr(t.ToMihon(h.GetUrl(), ChapterURL))
+	}
+}
+
+// withKotatsuURLs returns a copy of a Mihon manga whose manga, chapter and history URLs are in Kotatsu's format
+func (t *URLTransform) withKotatsuURLs(m *pb.BackupManga) *pb.BackupManga {
+	m = proto.Clone(m).(*pb.BackupManga)
+	m.Url = stringPtr(t.ToKotatsu(m.GetUrl(), MangaURL))
+	for _, c := range m.Chapters {
+		c.Url = stringPtr(t.ToKotatsu(c.GetUrl(), ChapterURL))
+	}
+	for _, h := range m.History {
+		h.Url = stringPtr(t.ToKotatsu(h.GetUrl(), ChapterURL))
+	}
+	return m
+}
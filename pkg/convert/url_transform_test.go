@@ -0,0 +1,97 @@
+package convert
+
+import (
+	"testing"
+
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+)
+
+func TestURLTransformRoundTrip(t *testing.T) {
+	const uuid = "9a4ef1c5-8a3e-4b2f-9c8d-1e2f3a4b5c6d"
+	absolute := &URLTransform{
+		BaseURL: "https://example.org/",
+		Kotatsu: URLStyle{Absolute: true, MangaPrefix: "/series/", ChapterPrefix: "/read/"},
+		Mihon:   URLStyle{MangaPrefix: "/manga/", ChapterPrefix: "/manga/chapter/"},
+	}
+	tests := []struct {
+		name    string
+		t       *URLTransform
+		kind    URLKind
+		kotatsu string
+		mihon   string
+	}{
+		{"mangadex manga", KnownSourceMapping["MANGADEX"].URLs, MangaURL, uuid, "/manga/" + uuid},
+		{"mangadex chapter", KnownSourceMapping["MANGADEX"].URLs, ChapterURL, uuid, "/chapter/" + uuid},
+		{"absolute manga", absolute, MangaURL, "https://example.org/series/one-piece", "/manga/one-piece"},
+		{"absolute chapter", absolute, ChapterURL, "https://example.org/read/one-piece-1?page=2", "/manga/chapter/one-piece-1?page=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.t.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.t.ToMihon(tt.kotatsu, tt.kind); got != tt.mihon {
+				t.Errorf("ToMihon(%q) = %q, want %q", tt.kotatsu, got, tt.mihon)
+			}
+			if got := tt.t.ToKotatsu(tt.mihon, tt.kind); got != tt.kotatsu {
+				t.Errorf("ToKotatsu(%q) = %q, want %q", tt.mihon, got, tt.kotatsu)
+			}
+		})
+	}
+}
+
+func TestURLTransformIDPattern(t *testing.T) {
+	const uuid = "9a4ef1c5-8a3e-4b2f-9c8d-1e2f3a4b5c6d"
+	tr := KnownSourceMapping["MANGADEX"].URLs
+	// website URLs pasted into Mihon keep only the UUID
+	for _, u := range []string{"/title/" + uuid, "https://mangadex.org/title/" + uuid} {
+		if got := tr.ToKotatsu(u, MangaURL); got != uuid {
+			t.Errorf("ToKotatsu(%q) = %q, want %q", u, got, uuid)
+		}
+	}
+	// URLs in neither format are left alone
+	if got := tr.ToKotatsu("/user/me", MangaURL); got != "/user/me" {
+		t.Errorf("ToKotatsu(/user/me) = %q", got)
+	}
+	if got := tr.PublicURL("/manga/" + uuid); got != "https://mangadex.org/manga/"+uuid {
+		t.Errorf("PublicURL = %q", got)
+	}
+}
+
+func TestMangaDexURLsRoundTrip(t *testing.T) {
+	const manga = "/manga/9a4ef1c5-8a3e-4b2f-9c8d-1e2f3a4b5c6d"
+	const chapter = "/chapter/0b1c2d3e-4f50-6172-8394-a5b6c7d8e9f0"
+	sourceID, _ := KnownSourceMapping["MANGADEX"].SourceID()
+	m := testMihonManga(sourceID, manga, testMihonChapter(chapter, 0, true, 0))
+	m.Favorite = boolPtr(true)
+	m.History = []*pb.BackupHistory{{Url: stringPtr(chapter), LastRead: int64Ptr(1000)}}
+	b := &pb.Backup{
+		BackupManga:   []*pb.BackupManga{m},
+		BackupSources: []*pb.BackupSource{{SourceId: int64Ptr(sourceID), Name: stringPtr("MangaDex")}},
+	}
+
+	kb, _ := MihonToKotatsu(b, Options{})
+	if len(kb.Favourites) != 1 || len(kb.Index) != 1 {
+		t.Fatalf("got %d favourites and %d index entries, want 1 each", len(kb.Favourites), len(kb.Index))
+	}
+	if got := kb.Favourites[0].Manga.Url; got != manga[len("/manga/"):] {
+		t.Errorf("kotatsu manga URL = %q", got)
+	}
+	back, _, err := KotatsuToMihon(kb, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(back.BackupManga) != 1 {
+		t.Fatalf("got %d manga, want 1", len(back.BackupManga))
+	}
+	got := back.BackupManga[0]
+	if got.GetUrl() != manga || got.GetSource() != sourceID {
+		t.Errorf("manga = %d %q, want %d %q", got.GetSource(), got.GetUrl(), sourceID, manga)
+	}
+	if len(got.Chapters) != 1 || got.Chapters[0].GetUrl() != chapter {
+		t.Errorf("chapters = %v, want %q", got.Chapters, chapter)
+	}
+	if len(got.History) != 1 || got.History[0].GetUrl() != chapter {
+		t.Errorf("history = %v, want %q", got.History, chapter)
+	}
+}
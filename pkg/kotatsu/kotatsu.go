@@ -1,11 +1,9 @@
 package kotatsu
 
 import (
-	"archive/zip"
 	"encoding/json"
-	"fmt"
 	"io"
-	"os"
+	"unicode/utf16"
 )
 
 // Minimal Kotatsu models used for conversion
@@ -15,12 +13,28 @@ type KotatsuBackup struct {
 	History    []KotatsuHistory        `json:"history"`
 	Bookmarks  []KotatsuBookmark       `json:"bookmarks"`
 	Index      []KotatsuIndexEntry     `json:"index"`
+	Scrobbling []KotatsuScrobbling     `json:"scrobbling"`
+	// Info is the backup metadata record Kotatsu stores in the "index" section
+	Info *KotatsuBackupInfo `json:"-"`
 	// Raw sections (for passthrough)
 	RawSettings   json.RawMessage `json:"-"`
 	RawReaderGrid json.RawMessage `json:"-"`
 	RawSources    json.RawMessage `json:"-"`
 }
 
+// Defaults used for the "index" metadata record when a backup has none
+const (
+	DefaultAppId      = "org.koitharu.kotatsu"
+	DefaultAppVersion = 1
+)
+
+// KotatsuBackupInfo identifies the app that produced a backup
+type KotatsuBackupInfo struct {
+	AppId      string `json:"app_id"`
+	AppVersion int    `json:"app_version"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
 type KotatsuFavouriteEntry struct {
 	MangaId    int64        `json:"manga_id"`
 	CategoryId int64        `json:"category_id"`
@@ -45,6 +59,8 @@ type KotatsuManga struct {
 	Author        string        `json:"author"`
 	Source        string        `json:"source"`
 	Tags          []interface{} `json:"tags"`
+	// Not part of Kotatsu's own backups, kept so descriptions survive a round trip
+	Description string `json:"description,omitempty"`
 }
 
 type KotatsuCategory struct {
@@ -62,6 +78,8 @@ type KotatsuHistory struct {
 	Page      int     `json:"page"`
 	Scroll    float64 `json:"scroll"`
 	Percent   float32 `json:"percent"`
+	// Kotatsu embeds the manga in history rows so it can restore entries that are not favourites
+	Manga *KotatsuManga `json:"manga,omitempty"`
 }
 
 type KotatsuBookmark struct {
@@ -75,6 +93,18 @@ type KotatsuBookmark struct {
 	Percent   float32 `json:"percent"`
 }
 
+// KotatsuScrobbling links a manga to an entry on a tracking service
+type KotatsuScrobbling struct {
+	Scrobbler int     `json:"scrobbler"` // ScrobblerService id (1 Shikimori, 2 AniList, 3 MAL, 4 Kitsu)
+	Id        int64   `json:"id"`        // library entry id on the service
+	MangaId   int64   `json:"manga_id"`
+	TargetId  int64   `json:"target_id"` // manga id on the service
+	Status    string  `json:"status"`
+	Chapter   int     `json:"chapter"`
+	Comment   string  `json:"comment"`
+	Rating    float32 `json:"rating"` // 0..1
+}
+
 type KotatsuIndexEntry struct {
 	MangaId  int64            `json:"manga_id"`
 	Chapters []KotatsuChapter `json:"chapters"`
@@ -90,104 +120,154 @@ type KotatsuChapter struct {
 	Branch     string  `json:"branch"`
 }
 
+// GenerateUid derives a manga or chapter ID the same way Kotatsu parsers do
+// (MangaParser.generateUid): a 31-based rolling hash over the UTF-16 code units
+// of the source name followed by the URL, seeded with 1125899906842597.
+func GenerateUid(source, url string) int64 {
+	h := int64(1125899906842597)
+	for _, c := range utf16.Encode([]rune(source)) {
+		h = 31*h + int64(c)
+	}
+	for _, c := range utf16.Encode([]rune(url)) {
+		h = 31*h + int64(c)
+	}
+	return h
+}
+
 // LoadKotatsuZip reads a Kotatsu zip and returns parsed backup data.
 func LoadKotatsuZip(path string) (*KotatsuBackup, error) {
-	r, err := zip.OpenReader(path)
+	r, err := OpenKotatsuZip(path)
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
+	return readBackup(r)
+}
 
-	kb := &KotatsuBackup{}
-	for _, f := range r.File {
-		rc, err := f.Open()
-		if err != nil {
-			return nil, err
-		}
+// ReadKotatsuZip parses a Kotatsu zip of the given size from ra.
+func ReadKotatsuZip(ra io.ReaderAt, size int64) (*KotatsuBackup, error) {
+	r, err := NewZipStreamReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	return readBackup(r)
+}
 
-		switch f.Name {
-		case "favourites":
-			var arr []KotatsuFavouriteEntry
-			if err := json.NewDecoder(rc).Decode(&arr); err != nil {
-				rc.Close()
-				return nil, fmt.Errorf("decode favourites: %w", err)
-			}
-			kb.Favourites = arr
-		case "categories":
-			var arr []KotatsuCategory
-			if err := json.NewDecoder(rc).Decode(&arr); err != nil {
-				rc.Close()
-				return nil, fmt.Errorf("decode categories: %w", err)
-			}
-			kb.Categories = arr
-		case "history":
-			var arr []KotatsuHistory
-			if err := json.NewDecoder(rc).Decode(&arr); err != nil {
-				rc.Close()
-				return nil, fmt.Errorf("decode history: %w", err)
-			}
-			kb.History = arr
-		case "bookmarks":
-			var arr []KotatsuBookmark
-			if err := json.NewDecoder(rc).Decode(&arr); err != nil {
-				rc.Close()
-				return nil, fmt.Errorf("decode bookmarks: %w", err)
-			}
-			kb.Bookmarks = arr
-		case "index":
-			var arr []KotatsuIndexEntry
-			if err := json.NewDecoder(rc).Decode(&arr); err != nil {
-				rc.Close()
-				return nil, fmt.Errorf("decode index: %w", err)
-			}
-			kb.Index = arr
-		case "settings", "reader_grid", "sources":
-			// Read raw bytes for passthrough
-			buf, err := io.ReadAll(rc)
-			if err != nil {
-				rc.Close()
-				return nil, fmt.Errorf("read %s: %w", f.Name, err)
-			}
-			switch f.Name {
-			case "settings":
-				kb.RawSettings = buf
-			case "reader_grid":
-				kb.RawReaderGrid = buf
-			case "sources":
-				kb.RawSources = buf
-			}
-		}
-		rc.Close()
+func readBackup(r *ZipStreamReader) (*KotatsuBackup, error) {
+	var err error
+	kb := &KotatsuBackup{}
+	if err := r.Index(func(info KotatsuBackupInfo) error {
+		kb.Info = &info
+		return nil
+	}, func(e KotatsuIndexEntry) error {
+		kb.Index = append(kb.Index, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := r.Favourites(func(e KotatsuFavouriteEntry) error {
+		kb.Favourites = append(kb.Favourites, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := r.Categories(func(c KotatsuCategory) error {
+		kb.Categories = append(kb.Categories, c)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := r.History(func(h KotatsuHistory) error {
+		kb.History = append(kb.History, h)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := r.Bookmarks(func(b KotatsuBookmark) error {
+		kb.Bookmarks = append(kb.Bookmarks, b)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := r.Scrobbling(func(s KotatsuScrobbling) error {
+		kb.Scrobbling = append(kb.Scrobbling, s)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	// Raw sections are kept for passthrough
+	if kb.RawSettings, err = r.Raw(SectionSettings); err != nil {
+		return nil, err
+	}
+	if kb.RawReaderGrid, err = r.Raw(SectionReaderGrid); err != nil {
+		return nil, err
+	}
+	if kb.RawSources, err = r.Raw(SectionSources); err != nil {
+		return nil, err
 	}
 	return kb, nil
 }
 
-// WriteKotatsuZip writes a minimal Kotatsu zip containing favourites and categories JSON arrays.
+// WriteKotatsuZip writes a Kotatsu zip containing every section LoadKotatsuZip understands.
+// The "index" section starts with the backup metadata record (a default one is
+// generated when kb.Info is nil) followed by the chapter lists. Raw sections are
+// only written when present.
 func WriteKotatsuZip(path string, kb *KotatsuBackup) error {
-	f, err := os.Create(path)
+	w, err := CreateKotatsuZip(path)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	zw := zip.NewWriter(f)
-	defer zw.Close()
+	w.Info = kb.Info
+	if err := writeSections(w, kb); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
 
-	add := func(name string, v interface{}) error {
-		w, err := zw.Create(name)
-		if err != nil {
-			return err
-		}
-		enc := json.NewEncoder(w)
-		enc.SetEscapeHTML(false)
-		enc.SetIndent("", "")
-		return enc.Encode(v)
+// WriteKotatsuZipTo writes the same archive as WriteKotatsuZip to out.
+func WriteKotatsuZipTo(out io.Writer, kb *KotatsuBackup) error {
+	w := NewZipStreamWriter(out)
+	w.Info = kb.Info
+	if err := writeSections(w, kb); err != nil {
+		return err
 	}
+	return w.Close()
+}
 
-	if err := add("favourites", kb.Favourites); err != nil {
-		return fmt.Errorf("write favourites: %w", err)
+func writeSections(w *ZipStreamWriter, kb *KotatsuBackup) error {
+	if err := appendAll(w, SectionIndex, kb.Index); err != nil {
+		return err
+	}
+	if err := appendAll(w, SectionFavourites, kb.Favourites); err != nil {
+		return err
 	}
-	if err := add("categories", kb.Categories); err != nil {
-		return fmt.Errorf("write categories: %w", err)
+	if err := appendAll(w, SectionCategories, kb.Categories); err != nil {
+		return err
+	}
+	if err := appendAll(w, SectionHistory, kb.History); err != nil {
+		return err
+	}
+	if err := appendAll(w, SectionBookmarks, kb.Bookmarks); err != nil {
+		return err
+	}
+	if err := appendAll(w, SectionScrobbling, kb.Scrobbling); err != nil {
+		return err
+	}
+	if err := w.WriteRaw(SectionSettings, kb.RawSettings); err != nil {
+		return err
+	}
+	if err := w.WriteRaw(SectionReaderGrid, kb.RawReaderGrid); err != nil {
+		return err
+	}
+	return w.WriteRaw(SectionSources, kb.RawSources)
+}
+
+func appendAll[T any](w *ZipStreamWriter, section string, items []T) error {
+	for _, v := range items {
+		if err := w.Append(section, v); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,113 @@
+package kotatsu
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestGenerateUid(t *testing.T) {
+	// Expected values follow MangaParser.generateUid in kotatsu-parsers, evaluated
+	// outside Go with Kotlin's Long (wrapping 64-bit) arithmetic over Char codes
+	tests := []struct {
+		source, url string
+		want        int64
+	}{
+		{"", "", 1125899906842597},
+		{"MANGADEX", "", -4898811344270594360},
+		{"MANGADEX", "/title/abc", 3412299933579011492},
+		{"MANGADEX", "9a4ef1c5-8a3e-4b2f-9c8d-1e2f3a4b5c6d", 5825738310746061903},
+		{"NIGHTSCANS", "/series/solo-leveling/", 1775716949602225743},
+		{"QISCANS", "/series/solo-leveling/", -6111479089198754171},
+		{"RAWKUMA", "/manga/日本語/", 1113085600115400897},
+		// characters outside the BMP count as two UTF-16 code units
+		{"MANGADEX", "/title/😀", -2270150850361430047},
+	}
+	for _, tt := range tests {
+		if got := GenerateUid(tt.source, tt.url); got != tt.want {
+			t.Errorf("GenerateUid(%q, %q) = %d, want %d", tt.source, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestZipRoundTrip(t *testing.T) {
+	manga := KotatsuManga{
+		Id:     GenerateUid("MANGADEX", "/title/abc"),
+		Title:  "One & <Two>",
+		Url:    "/title/abc",
+		Source: "MANGADEX",
+		State:  "ONGOING",
+		Tags:   []interface{}{map[string]interface{}{"key": "action", "title": "Action", "source": "MANGADEX"}},
+	}
+	chapter := KotatsuChapter{Id: GenerateUid("MANGADEX", "/chapter/1"), Name: "Chapter 1", Number: 1, Url: "/chapter/1", UploadDate: 1700000000000}
+	kb := &KotatsuBackup{
+		Info:       &KotatsuBackupInfo{AppId: DefaultAppId, AppVersion: 42, CreatedAt: 1700000000000},
+		Index:      []KotatsuIndexEntry{{MangaId: manga.Id, Chapters: []KotatsuChapter{chapter}}},
+		Favourites: []KotatsuFavouriteEntry{{MangaId: manga.Id, CategoryId: 1, CreatedAt: 1, Manga: manga}},
+		Categories: []KotatsuCategory{{CategoryId: 1, CreatedAt: 1, Title: "Reading"}},
+		History:    []KotatsuHistory{{MangaId: manga.Id, ChapterId: chapter.Id, UpdatedAt: 2, Page: 3, Percent: 0.5, Manga: &manga}},
+		Bookmarks:  []KotatsuBookmark{{MangaId: manga.Id, ChapterId: chapter.Id, PageId: 7, Page: 3}},
+		Scrobbling: []KotatsuScrobbling{{Scrobbler: 2, Id: 5, MangaId: manga.Id, TargetId: 9, Status: "reading", Chapter: 1}},
+
+		RawSettings:   json.RawMessage(`[{"reader_mode":"webtoon"}]`),
+		RawReaderGrid: json.RawMessage(`[{"size":100}]`),
+		RawSources:    json.RawMessage(`[{"source":"MANGADEX","enabled":true}]`),
+	}
+
+	var buf bytes.Buffer
+	if err := WriteKotatsuZipTo(&buf, kb); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadKotatsuZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, kb) {
+		t.Errorf("round trip changed the backup:\ngot  %+v\nwant %+v", got, kb)
+	}
+}
+
+func TestZipStreamWriterEmptySections(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewZipStreamWriter(&buf)
+	if err := w.Append(SectionCategories, KotatsuCategory{CategoryId: 1, Title: "Reading"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewZipStreamReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{SectionIndex, SectionFavourites, SectionHistory, SectionBookmarks, SectionScrobbling} {
+		if !r.Has(section) {
+			t.Errorf("section %s is missing", section)
+		}
+	}
+	kb, err := readBackup(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kb.Info == nil || kb.Info.AppId != DefaultAppId {
+		t.Errorf("index metadata = %+v, want a default record", kb.Info)
+	}
+	if len(kb.Categories) != 1 || len(kb.Favourites) != 0 {
+		t.Errorf("got %d categories and %d favourites, want 1 and 0", len(kb.Categories), len(kb.Favourites))
+	}
+}
+
+func TestZipStreamWriterReopenSection(t *testing.T) {
+	w := NewZipStreamWriter(&bytes.Buffer{})
+	if err := w.Append(SectionHistory, KotatsuHistory{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(SectionBookmarks, KotatsuBookmark{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(SectionHistory, KotatsuHistory{}); err == nil {
+		t.Error("appending to a finished section succeeded")
+	}
+}
@@ -0,0 +1,362 @@
+package kotatsu
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Section names used inside Kotatsu backup zips
+const (
+	SectionIndex      = "index"
+	SectionFavourites = "favourites"
+	SectionCategories = "categories"
+	SectionHistory    = "history"
+	SectionBookmarks  = "bookmarks"
+	SectionScrobbling = "scrobbling"
+	SectionSettings   = "settings"
+	SectionReaderGrid = "reader_grid"
+	SectionSources    = "sources"
+)
+
+// arraySections are always present in written backups, empty sections are written as []
+var arraySections = []string{
+	SectionIndex,
+	SectionFavourites,
+	SectionCategories,
+	SectionHistory,
+	SectionBookmarks,
+	SectionScrobbling,
+}
+
+// ZipStreamReader reads a Kotatsu zip one array element at a time instead of
+// decoding whole sections into slices.
+type ZipStreamReader struct {
+	closer io.Closer
+	files  map[string]*zip.File
+}
+
+// OpenKotatsuZip opens a Kotatsu zip for streaming. The caller must Close it.
+func OpenKotatsuZip(path string) (*ZipStreamReader, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	r := newZipStreamReader(&zr.Reader)
+	r.closer = zr
+	return r, nil
+}
+
+// NewZipStreamReader streams a Kotatsu zip of the given size from ra.
+func NewZipStreamReader(ra io.ReaderAt, size int64) (*ZipStreamReader, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	return newZipStreamReader(zr), nil
+}
+
+func newZipStreamReader(zr *zip.Reader) *ZipStreamReader {
+	r := &ZipStreamReader{files: make(map[string]*zip.File)}
+	for _, f := range zr.File {
+		r.files[f.Name] = f
+	}
+	return r
+}
+
+// Close closes the underlying zip file when it was opened from a path
+func (r *ZipStreamReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// Has reports whether the backup contains the named section
+func (r *ZipStreamReader) Has(section string) bool {
+	_, ok := r.files[section]
+	return ok
+}
+
+// Favourites calls fn for every favourite row
+func (r *ZipStreamReader) Favourites(fn func(KotatsuFavouriteEntry) error) error {
+	return streamSection(r, SectionFavourites, fn)
+}
+
+// Categories calls fn for every category
+func (r *ZipStreamReader) Categories(fn func(KotatsuCategory) error) error {
+	return streamSection(r, SectionCategories, fn)
+}
+
+// History calls fn for every history row
+func (r *ZipStreamReader) History(fn func(KotatsuHistory) error) error {
+	return streamSection(r, SectionHistory, fn)
+}
+
+// Bookmarks calls fn for every bookmark
+func (r *ZipStreamReader) Bookmarks(fn func(KotatsuBookmark) error) error {
+	return streamSection(r, SectionBookmarks, fn)
+}
+
+// Scrobbling calls fn for every tracker link
+func (r *ZipStreamReader) Scrobbling(fn func(KotatsuScrobbling) error) error {
+	return streamSection(r, SectionScrobbling, fn)
+}
+
+// Index walks the "index" section, calling onInfo for the backup metadata record
+// and onEntry for every chapter list. Either callback may be nil.
+func (r *ZipStreamReader) Index(onInfo func(KotatsuBackupInfo) error, onEntry func(KotatsuIndexEntry) error) error {
+	return streamSection(r, SectionIndex, func(raw json.RawMessage) error {
+		var probe map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &probe); err != nil {
+			return err
+		}
+		if _, ok := probe["app_id"]; ok {
+			if onInfo == nil {
+				return nil
+			}
+			var info KotatsuBackupInfo
+			if err := json.Unmarshal(raw, &info); err != nil {
+				return err
+			}
+			return onInfo(info)
+		}
+		if onEntry == nil {
+			return nil
+		}
+		var entry KotatsuIndexEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return err
+		}
+		return onEntry(entry)
+	})
+}
+
+// Raw returns the undecoded contents of a section, or nil if it is missing
+func (r *ZipStreamReader) Raw(section string) (json.RawMessage, error) {
+	f, ok := r.files[section]
+	if !ok {
+		return nil, nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	buf, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", section, err)
+	}
+	return buf, nil
+}
+
+// streamSection decodes the JSON array in a section element by element.
+// Missing sections are treated as empty.
+func streamSection[T any](r *ZipStreamReader, section string, fn func(T) error) error {
+	f, ok := r.files[section]
+	if !ok {
+		return nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dec := json.NewDecoder(rc)
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", section, err)
+	}
+	// Tolerate "null" for empty sections
+	if tok == nil {
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("decode %s: expected array, got %v", section, tok)
+	}
+	for dec.More() {
+		var v T
+		if err := dec.Decode(&v); err != nil {
+			return fmt.Errorf("decode %s: %w", section, err)
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("decode %s: %w", section, err)
+	}
+	return nil
+}
+
+// ZipStreamWriter writes a Kotatsu zip incrementally. Elements of a section
+// must be appended contiguously since a zip entry cannot be reopened once the
+// next one has started.
+type ZipStreamWriter struct {
+	// Info is written as the first element of the "index" section. A default
+	// record is generated when it is nil.
+	Info *KotatsuBackupInfo
+
+	closer  io.Closer
+	zw      *zip.Writer
+	enc     *json.Encoder
+	w       io.Writer
+	current string
+	count   int
+	done    map[string]bool
+}
+
+// CreateKotatsuZip creates a Kotatsu zip for incremental writing. Close must be
+// called to finish the archive.
+func CreateKotatsuZip(path string) (*ZipStreamWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := NewZipStreamWriter(f)
+	w.closer = f
+	return w, nil
+}
+
+// NewZipStreamWriter writes a Kotatsu zip to out. Close finishes the archive
+// but does not close out.
+func NewZipStreamWriter(out io.Writer) *ZipStreamWriter {
+	return &ZipStreamWriter{
+		zw:   zip.NewWriter(out),
+		done: make(map[string]bool),
+	}
+}
+
+// Append adds one element to the JSON array of a section
+func (w *ZipStreamWriter) Append(section string, v interface{}) error {
+	if section != w.current {
+		if err := w.begin(section); err != nil {
+			return err
+		}
+		if section == SectionIndex {
+			if err := w.append(w.info()); err != nil {
+				return err
+			}
+		}
+	}
+	return w.append(v)
+}
+
+// WriteRaw writes a section verbatim. Empty sections are skipped.
+func (w *ZipStreamWriter) WriteRaw(section string, raw json.RawMessage) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := w.finish(); err != nil {
+		return err
+	}
+	if w.done[section] {
+		return fmt.Errorf("section %s already written", section)
+	}
+	out, err := w.zw.Create(section)
+	if err != nil {
+		return err
+	}
+	w.done[section] = true
+	if _, err := out.Write(raw); err != nil {
+		return fmt.Errorf("write %s: %w", section, err)
+	}
+	return nil
+}
+
+// Close finishes the current section, writes any missing array sections as
+// empty arrays (the index gets its metadata record) and closes the file if
+// the writer was created from a path.
+func (w *ZipStreamWriter) Close() error {
+	err := w.finish()
+	for _, section := range arraySections {
+		if err != nil || w.done[section] {
+			continue
+		}
+		if err = w.begin(section); err == nil && section == SectionIndex {
+			err = w.append(w.info())
+		}
+		if err == nil {
+			err = w.finish()
+		}
+	}
+	if cerr := w.zw.Close(); err == nil {
+		err = cerr
+	}
+	if w.closer != nil {
+		if cerr := w.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (w *ZipStreamWriter) info() *KotatsuBackupInfo {
+	if w.Info != nil {
+		return w.Info
+	}
+	return &KotatsuBackupInfo{
+		AppId:      DefaultAppId,
+		AppVersion: DefaultAppVersion,
+		CreatedAt:  time.Now().UnixMilli(),
+	}
+}
+
+// begin closes the current section and opens a new zip entry with "["
+func (w *ZipStreamWriter) begin(section string) error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+	if w.done[section] {
+		return fmt.Errorf("section %s already written", section)
+	}
+	out, err := w.zw.Create(section)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(out, "["); err != nil {
+		return fmt.Errorf("write %s: %w", section, err)
+	}
+	w.enc = json.NewEncoder(out)
+	w.enc.SetEscapeHTML(false)
+	w.w = out
+	w.current = section
+	w.count = 0
+	w.done[section] = true
+	return nil
+}
+
+func (w *ZipStreamWriter) append(v interface{}) error {
+	if w.current == "" {
+		return errors.New("no section started")
+	}
+	if w.count > 0 {
+		if _, err := io.WriteString(w.w, ","); err != nil {
+			return fmt.Errorf("write %s: %w", w.current, err)
+		}
+	}
+	if err := w.enc.Encode(v); err != nil {
+		return fmt.Errorf("write %s: %w", w.current, err)
+	}
+	w.count++
+	return nil
+}
+
+// finish terminates the array of the current section, if any
+func (w *ZipStreamWriter) finish() error {
+	if w.current == "" {
+		return nil
+	}
+	if _, err := io.WriteString(w.w, "]"); err != nil {
+		return fmt.Errorf("write %s: %w", w.current, err)
+	}
+	w.current = ""
+	w.enc = nil
+	w.w = nil
+	return nil
+}
@@ -1,6 +1,7 @@
 package mihon
 
 import (
+	"bufio"
 	"compress/gzip"
 	"io"
 	"os"
@@ -17,33 +18,20 @@ func LoadBackup(path string) (*pb.Backup, error) {
 		return nil, err
 	}
 	defer f.Close()
+	return ReadBackup(f)
+}
 
-	// Read first two bytes to detect gzip (0x1f8b magic)
-	hdr := make([]byte, 2)
-	if _, err := f.Read(hdr); err != nil {
-		return nil, err
-	}
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
+// ReadBackup reads a Mihon backup from r, which may be gzipped or plain protobuf.
+func ReadBackup(r io.Reader) (*pb.Backup, error) {
+	dr, closeFn, err := decompress(r)
+	if err != nil {
 		return nil, err
 	}
+	defer closeFn()
 
-	var data []byte
-	// Check for gzip magic bytes
-	if hdr[0] == 0x1f && hdr[1] == 0x8b {
-		gr, err := gzip.NewReader(f)
-		if err != nil {
-			return nil, err
-		}
-		defer gr.Close()
-		data, err = io.ReadAll(gr)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		data, err = io.ReadAll(f)
-		if err != nil {
-			return nil, err
-		}
+	data, err := io.ReadAll(dr)
+	if err != nil {
+		return nil, err
 	}
 
 	// Unmarshal using generated protobuf code
@@ -58,23 +46,50 @@ func LoadBackup(path string) (*pb.Backup, error) {
 // WriteBackup writes a Mihon backup using protoc-generated types.
 // Marshals to protobuf and gzips the output.
 func WriteBackup(path string, backup *pb.Backup) error {
-	// Marshal using generated protobuf code
-	data, err := proto.Marshal(backup)
+	// Create output file
+	outf, err := os.Create(path)
 	if err != nil {
 		return err
 	}
+	if err := WriteBackupTo(outf, backup); err != nil {
+		outf.Close()
+		return err
+	}
+	return outf.Close()
+}
 
-	// Create output file
-	outf, err := os.Create(path)
+// WriteBackupTo writes a gzipped Mihon backup to w.
+func WriteBackupTo(w io.Writer, backup *pb.Backup) error {
+	// Marshal using generated protobuf code
+	data, err := proto.Marshal(backup)
 	if err != nil {
 		return err
 	}
-	defer outf.Close()
 
 	// Gzip compress
-	gw := gzip.NewWriter(outf)
-	defer gw.Close()
+	gw := gzip.NewWriter(w)
+	if _, err := gw.Write(data); err != nil {
+		gw.Close()
+		return err
+	}
+	return gw.Close()
+}
 
-	_, err = gw.Write(data)
-	return err
+// decompress returns a reader for the protobuf payload of a backup, transparently
+// handling gzip by peeking at the magic bytes (0x1f8b). The returned close
+// function must be called once reading is done.
+func decompress(r io.Reader) (*bufio.Reader, func() error, error) {
+	br := bufio.NewReader(r)
+	hdr, err := br.Peek(2)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr[0] != 0x1f || hdr[1] != 0x8b {
+		return br, func() error { return nil }, nil
+	}
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bufio.NewReader(gr), gr.Close, nil
 }
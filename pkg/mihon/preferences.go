@@ -0,0 +1,126 @@
+package mihon
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+	"google.golang.org/protobuf/proto"
+)
+
+// kotlinx serial names Mihon writes to PreferenceValue.type
+const (
+	PreferenceTypeInt       = "eu.kanade.tachiyomi.data.backup.models.IntPreferenceValue"
+	PreferenceTypeLong      = "eu.kanade.tachiyomi.data.backup.models.LongPreferenceValue"
+	PreferenceTypeFloat     = "eu.kanade.tachiyomi.data.backup.models.FloatPreferenceValue"
+	PreferenceTypeString    = "eu.kanade.tachiyomi.data.backup.models.StringPreferenceValue"
+	PreferenceTypeBoolean   = "eu.kanade.tachiyomi.data.backup.models.BooleanPreferenceValue"
+	PreferenceTypeStringSet = "eu.kanade.tachiyomi.data.backup.models.StringSetPreferenceValue"
+)
+
+// newPreferenceMessage returns an empty message for a type name. Only the simple
+// class name is compared so shortened or relocated serial names still decode.
+func newPreferenceMessage(typeName string) (proto.Message, error) {
+	switch typeName[strings.LastIndexByte(typeName, '.')+1:] {
+	case "IntPreferenceValue":
+		return &pb.IntPreferenceValue{}, nil
+	case "LongPreferenceValue":
+		return &pb.LongPreferenceValue{}, nil
+	case "FloatPreferenceValue":
+		return &pb.FloatPreferenceValue{}, nil
+	case "StringPreferenceValue":
+		return &pb.StringPreferenceValue{}, nil
+	case "BooleanPreferenceValue":
+		return &pb.BooleanPreferenceValue{}, nil
+	case "StringSetPreferenceValue":
+		return &pb.StringSetPreferenceValue{}, nil
+	}
+	return nil, fmt.Errorf("unknown preference type %q", typeName)
+}
+
+// DecodePreference decodes PreferenceValue.truevalue into the message matching
+// its type: *pb.IntPreferenceValue, *pb.LongPreferenceValue, *pb.FloatPreferenceValue,
+// *pb.StringPreferenceValue, *pb.BooleanPreferenceValue or *pb.StringSetPreferenceValue
+func DecodePreference(v *pb.PreferenceValue) (proto.Message, error) {
+	msg, err := newPreferenceMessage(v.GetType())
+	if err != nil {
+		return nil, err
+	}
+	if err := proto.Unmarshal(v.GetTruevalue(), msg); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", v.GetType(), err)
+	}
+	return msg, nil
+}
+
+// PreferenceGoValue decodes a PreferenceValue into int32, int64, float32, string, bool or []string
+func PreferenceGoValue(v *pb.PreferenceValue) (any, error) {
+	msg, err := DecodePreference(v)
+	if err != nil {
+		return nil, err
+	}
+	switch m := msg.(type) {
+	case *pb.IntPreferenceValue:
+		return m.GetValue(), nil
+	case *pb.LongPreferenceValue:
+		return m.GetValue(), nil
+	case *pb.FloatPreferenceValue:
+		return m.GetValue(), nil
+	case *pb.StringPreferenceValue:
+		return m.GetValue(), nil
+	case *pb.BooleanPreferenceValue:
+		return m.GetValue(), nil
+	default:
+		return msg.(*pb.StringSetPreferenceValue).GetValue(), nil
+	}
+}
+
+// EncodePreference builds a PreferenceValue from an int32, int64, float32,
+// string, bool or []string. Plain ints become IntPreferenceValue and float64
+// becomes FloatPreferenceValue, as Mihon has no wider types; values outside the
+// range of int32 / float32 are an error.
+func EncodePreference(v any) (*pb.PreferenceValue, error) {
+	var typ string
+	var msg proto.Message
+	switch t := v.(type) {
+	case int:
+		if t < math.MinInt32 || t > math.MaxInt32 {
+			return nil, fmt.Errorf("int preference value %d overflows int32", t)
+		}
+		typ, msg = PreferenceTypeInt, &pb.IntPreferenceValue{Value: proto.Int32(int32(t))}
+	case int32:
+		typ, msg = PreferenceTypeInt, &pb.IntPreferenceValue{Value: proto.Int32(t)}
+	case int64:
+		typ, msg = PreferenceTypeLong, &pb.LongPreferenceValue{Value: proto.Int64(t)}
+	case float32:
+		typ, msg = PreferenceTypeFloat, &pb.FloatPreferenceValue{Value: proto.Float32(t)}
+	case float64:
+		// NaN and infinities stay as they are; finite values must not round to infinity
+		if !math.IsInf(t, 0) && math.IsInf(float64(float32(t)), 0) {
+			return nil, fmt.Errorf("float preference value %g overflows float32", t)
+		}
+		typ, msg = PreferenceTypeFloat, &pb.FloatPreferenceValue{Value: proto.Float32(float32(t))}
+	case string:
+		typ, msg = PreferenceTypeString, &pb.StringPreferenceValue{Value: proto.String(t)}
+	case bool:
+		typ, msg = PreferenceTypeBoolean, &pb.BooleanPreferenceValue{Value: proto.Bool(t)}
+	case []string:
+		typ, msg = PreferenceTypeStringSet, &pb.StringSetPreferenceValue{Value: t}
+	default:
+		return nil, fmt.Errorf("unsupported preference value %T", v)
+	}
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PreferenceValue{Type: proto.String(typ), Truevalue: raw}, nil
+}
+
+// NewPreference builds a BackupPreference for key from a Go value (see EncodePreference)
+func NewPreference(key string, v any) (*pb.BackupPreference, error) {
+	value, err := EncodePreference(v)
+	if err != nil {
+		return nil, fmt.Errorf("preference %s: %w", key, err)
+	}
+	return &pb.BackupPreference{Key: proto.String(key), Value: value}, nil
+}
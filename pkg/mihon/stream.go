@@ -0,0 +1,129 @@
+package mihon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// backupMangaField is the field number of Backup.backupManga
+const backupMangaField protowire.Number = 1
+
+// maxFieldSize guards against corrupt length prefixes allocating huge buffers
+const maxFieldSize = 256 << 20
+
+// StreamBackup decodes a Mihon backup file one top-level field at a time.
+// Every BackupManga is passed to onManga as soon as it is decoded and is not
+// retained, so memory use is bounded by the largest single manga rather than
+// the whole library. All other top-level fields (categories, sources,
+// preferences, extension repos) are small and are collected into the returned
+// Backup, whose BackupManga is left empty.
+//
+// Returning an error from onManga stops decoding and the error is returned as is.
+func StreamBackup(path string, onManga func(*pb.BackupManga) error) (*pb.Backup, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return StreamBackupFrom(f, onManga)
+}
+
+// StreamBackupFrom is StreamBackup for an arbitrary, possibly gzipped, reader.
+func StreamBackupFrom(rd io.Reader, onManga func(*pb.BackupManga) error) (*pb.Backup, error) {
+	r, closeFn, err := decompress(rd)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFn()
+
+	backup := &pb.Backup{}
+	var buf []byte
+	for {
+		tag, err := binary.ReadUvarint(r)
+		if errors.Is(err, io.EOF) {
+			return backup, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read field tag: %w", err)
+		}
+		num, typ := protowire.DecodeTag(tag)
+		if num <= 0 {
+			return nil, fmt.Errorf("invalid field number %d", num)
+		}
+
+		// Backup only has repeated message fields; anything else is unknown and skipped
+		if typ != protowire.BytesType {
+			if err := skipField(r, typ); err != nil {
+				return nil, fmt.Errorf("skip field %d: %w", num, err)
+			}
+			continue
+		}
+
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("read field %d length: %w", num, unexpectedEOF(err))
+		}
+		if size > maxFieldSize {
+			return nil, fmt.Errorf("field %d too large (%d bytes)", num, size)
+		}
+		if uint64(cap(buf)) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("read field %d: %w", num, unexpectedEOF(err))
+		}
+
+		if num == backupMangaField {
+			m := &pb.BackupManga{}
+			if err := proto.Unmarshal(buf, m); err != nil {
+				return nil, fmt.Errorf("decode manga: %w", err)
+			}
+			if err := onManga(m); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Re-encode the single field and merge it so the generated code handles it
+		field := protowire.AppendTag(nil, num, typ)
+		field = protowire.AppendBytes(field, buf)
+		if err := (proto.UnmarshalOptions{Merge: true}).Unmarshal(field, backup); err != nil {
+			return nil, fmt.Errorf("decode field %d: %w", num, err)
+		}
+	}
+}
+
+// skipField discards a non length-delimited field value
+func skipField(r *bufio.Reader, typ protowire.Type) error {
+	var n int64
+	switch typ {
+	case protowire.VarintType:
+		_, err := binary.ReadUvarint(r)
+		return unexpectedEOF(err)
+	case protowire.Fixed32Type:
+		n = 4
+	case protowire.Fixed64Type:
+		n = 8
+	default:
+		return fmt.Errorf("unsupported wire type %d", typ)
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return unexpectedEOF(err)
+}
+
+// unexpectedEOF turns io.EOF in the middle of a field into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
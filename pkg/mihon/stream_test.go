@@ -0,0 +1,124 @@
+package mihon
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	pb "github.com/galpt/mk-bkconv/proto/mihon"
+	"google.golang.org/protobuf/proto"
+)
+
+func testBackup(t *testing.T) *pb.Backup {
+	t.Helper()
+	pref, err := NewPreference("pref_library_columns", int32(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manga := func(url string) *pb.BackupManga {
+		return &pb.BackupManga{
+			Source:     proto.Int64(2499283573021220255),
+			Url:        proto.String(url),
+			Title:      proto.String("Manga " + url),
+			Genre:      []string{"Action"},
+			Categories: []int64{1},
+			Chapters: []*pb.BackupChapter{
+				{Url: proto.String(url + "/1"), Name: proto.String("Chapter 1"), Read: proto.Bool(true), SourceOrder: proto.Int64(1)},
+				{Url: proto.String(url + "/2"), Name: proto.String("Chapter 2"), LastPageRead: proto.Int64(4)},
+			},
+			History:  []*pb.BackupHistory{{Url: proto.String(url + "/2"), LastRead: proto.Int64(1700000000000)}},
+			Tracking: []*pb.BackupTracking{{SyncId: proto.Int32(2), LibraryId: proto.Int64(7)}},
+		}
+	}
+	return &pb.Backup{
+		BackupManga:       []*pb.BackupManga{manga("/title/a"), manga("/title/b"), manga("/title/c")},
+		BackupCategories:  []*pb.BackupCategory{{Name: proto.String("Reading"), Order: proto.Int64(1), Id: proto.Int64(1)}},
+		BackupSources:     []*pb.BackupSource{{Name: proto.String("MangaDex"), SourceId: proto.Int64(2499283573021220255)}},
+		BackupPreferences: []*pb.BackupPreference{pref},
+		BackupSourcePreferences: []*pb.BackupSourcePreferences{
+			{SourceKey: proto.String("source_2499283573021220255"), Prefs: []*pb.BackupPreference{pref}},
+		},
+		BackupExtensionRepo: []*pb.BackupExtensionRepos{{
+			BaseUrl: proto.String("https://example.org/repo"), Name: proto.String("Repo"),
+			Website: proto.String("https://example.org"), SigningKeyFingerprint: proto.String("00"),
+		}},
+	}
+}
+
+// streamAll collects the manga passed to onManga back into the returned header
+func streamAll(t *testing.T, data []byte) *pb.Backup {
+	t.Helper()
+	var manga []*pb.BackupManga
+	b, err := StreamBackupFrom(bytes.NewReader(data), func(m *pb.BackupManga) error {
+		manga = append(manga, m)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.BackupManga) != 0 {
+		t.Errorf("header holds %d manga, want none", len(b.BackupManga))
+	}
+	b.BackupManga = manga
+	return b
+}
+
+func TestStreamBackupMatchesReadBackup(t *testing.T) {
+	var gz bytes.Buffer
+	if err := WriteBackupTo(&gz, testBackup(t)); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := proto.Marshal(testBackup(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Concatenated messages merge, so this puts manga after the other fields
+	head := testBackup(t)
+	tail := &pb.Backup{BackupManga: head.BackupManga[1:]}
+	head.BackupManga = head.BackupManga[:1]
+	interleaved, err := proto.Marshal(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := proto.Marshal(tail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interleaved = append(interleaved, rest...)
+
+	for name, data := range map[string][]byte{"gzip": gz.Bytes(), "uncompressed": raw, "interleaved": interleaved} {
+		t.Run(name, func(t *testing.T) {
+			want, err := ReadBackup(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := streamAll(t, data); !proto.Equal(got, want) {
+				t.Errorf("StreamBackupFrom differs from ReadBackup:\ngot  %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+func TestStreamBackupStops(t *testing.T) {
+	var gz bytes.Buffer
+	if err := WriteBackupTo(&gz, testBackup(t)); err != nil {
+		t.Fatal(err)
+	}
+	stop := errors.New("stop")
+	n := 0
+	_, err := StreamBackupFrom(bytes.NewReader(gz.Bytes()), func(*pb.BackupManga) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("got error %v after %d manga, want %v after 1", err, n, stop)
+	}
+
+	raw, err := proto.Marshal(testBackup(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := StreamBackupFrom(bytes.NewReader(raw[:len(raw)-3]), func(*pb.BackupManga) error { return nil }); err == nil {
+		t.Error("truncated backup decoded without error")
+	}
+}
@@ -13,35 +13,68 @@ import (
 
 func main() {
 	in := flag.String("in", "", "input mihon backup file (.tachibk)")
+	prefs := flag.Bool("prefs", false, "print the decoded app and source preferences")
 	flag.Parse()
 	if *in == "" {
 		log.Fatal("-in required")
 	}
 
-	// Load the backup
-	backup, err := mihon.LoadBackup(*in)
+	// Stream the backup so very large libraries can be analyzed in bounded memory
+	var first *pb.BackupManga
+	counts := &issueCounts{}
+	backup, err := mihon.StreamBackup(*in, func(m *pb.BackupManga) error {
+		if first == nil {
+			first = m
+		}
+		counts.add(m)
+		return nil
+	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error loading backup: %v\n", err)
 		os.Exit(2)
 	}
 
 	fmt.Printf("=== BACKUP ANALYSIS ===\n\n")
-	fmt.Printf("Manga count: %d\n", len(backup.BackupManga))
+	fmt.Printf("Manga count: %d\n", counts.manga)
 	fmt.Printf("Category count: %d\n", len(backup.BackupCategories))
 	fmt.Printf("Source count: %d\n", len(backup.BackupSources))
 	fmt.Printf("Preferences count: %d\n", len(backup.BackupPreferences))
 	fmt.Printf("Source Preferences count: %d\n", len(backup.BackupSourcePreferences))
 	fmt.Printf("Extension Repos count: %d\n\n", len(backup.BackupExtensionRepo))
 
-	if len(backup.BackupManga) > 0 {
+	if *prefs {
+		printPreferences(backup)
+	}
+
+	if first != nil {
 		fmt.Printf("=== FIRST MANGA DETAILS ===\n")
-		m := backup.BackupManga[0]
-		analyzeBackupManga(m)
+		analyzeBackupManga(first)
 	}
 
-	if len(backup.BackupManga) > 0 {
+	if counts.manga > 0 {
 		fmt.Printf("\n=== CHECKING FOR COMMON ISSUES ===\n")
-		checkForIssues(backup)
+		checkForIssues(backup, counts)
+	}
+}
+
+// issueCounts accumulates per-manga problems while the backup is streamed
+type issueCounts struct {
+	manga         int
+	zeroSources   int
+	uninitialized int
+	noDateAdded   int
+}
+
+func (c *issueCounts) add(m *pb.BackupManga) {
+	c.manga++
+	if m.GetSource() == 0 {
+		c.zeroSources++
+	}
+	if !m.GetInitialized() {
+		c.uninitialized++
+	}
+	if m.GetDateAdded() == 0 {
+		c.noDateAdded++
 	}
 }
 
@@ -76,40 +109,44 @@ func analyzeBackupManga(m *pb.BackupManga) {
 	fmt.Println(string(data))
 }
 
-func checkForIssues(backup *pb.Backup) {
+func printPreferences(backup *pb.Backup) {
+	fmt.Printf("=== PREFERENCES ===\n")
+	for _, p := range backup.BackupPreferences {
+		printPreference("", p)
+	}
+	for _, sp := range backup.BackupSourcePreferences {
+		for _, p := range sp.GetPrefs() {
+			printPreference(sp.GetSourceKey()+": ", p)
+		}
+	}
+	fmt.Println()
+}
+
+func printPreference(prefix string, p *pb.BackupPreference) {
+	v, err := mihon.PreferenceGoValue(p.GetValue())
+	if err != nil {
+		fmt.Printf("%s%s = <%v>\n", prefix, p.GetKey(), err)
+		return
+	}
+	fmt.Printf("%s%s = %v (%T)\n", prefix, p.GetKey(), v, v)
+}
+
+func checkForIssues(backup *pb.Backup, counts *issueCounts) {
 	issues := []string{}
 
 	// Check for zero source IDs
-	zeroSources := 0
-	for _, m := range backup.BackupManga {
-		if m.GetSource() == 0 {
-			zeroSources++
-		}
-	}
-	if zeroSources > 0 {
-		issues = append(issues, fmt.Sprintf("⚠️  %d manga have source = 0 (likely invalid)", zeroSources))
+	if counts.zeroSources > 0 {
+		issues = append(issues, fmt.Sprintf("⚠️  %d manga have source = 0 (likely invalid)", counts.zeroSources))
 	}
 
 	// Check for uninitialized manga
-	uninitialized := 0
-	for _, m := range backup.BackupManga {
-		if !m.GetInitialized() {
-			uninitialized++
-		}
-	}
-	if uninitialized > 0 {
-		issues = append(issues, fmt.Sprintf("⚠️  %d manga have initialized = false", uninitialized))
+	if counts.uninitialized > 0 {
+		issues = append(issues, fmt.Sprintf("⚠️  %d manga have initialized = false", counts.uninitialized))
 	}
 
 	// Check for missing timestamps
-	noDateAdded := 0
-	for _, m := range backup.BackupManga {
-		if m.GetDateAdded() == 0 {
-			noDateAdded++
-		}
-	}
-	if noDateAdded > 0 {
-		issues = append(issues, fmt.Sprintf("⚠️  %d manga have dateAdded = 0", noDateAdded))
+	if counts.noDateAdded > 0 {
+		issues = append(issues, fmt.Sprintf("⚠️  %d manga have dateAdded = 0", counts.noDateAdded))
 	}
 
 	// Check for empty sources list